@@ -16,6 +16,7 @@ type AstHandle struct {
 	I2c      pmem.Region
 	wdt      pmem.Region
 	lpc      pmem.Region
+	gpio     pmem.Region
 	dram     pmem.Region
 	mac      [2]pmem.Region
 	Family   int
@@ -69,7 +70,7 @@ type AstPrevState struct {
 // Return a bitmask of which i2c busses have their pin enabled.
 func (a *AstHandle) I2cEnabledSet() uint32 {
 	if a.Family == 26 {
-		return (1 << 3) + (1 << 2)
+		return a.i2cEnabledSet26()
 	}
 	i2cEnabled := (a.scu.Read32(0x90) & 0xfff0000) >> 14
 	if a.Family >= 25 {
@@ -81,6 +82,13 @@ func (a *AstHandle) I2cEnabledSet() uint32 {
 	return i2cEnabled
 }
 
+func (a *AstHandle) I2cBuses() int {
+	if a.Family >= 26 {
+		return 16
+	}
+	return 14
+}
+
 func (a *AstHandle) I2cBase(i int) (base int64) {
 	off := 0x40
 	if a.Family >= 26 {
@@ -146,7 +154,7 @@ func (a *AstHandle) AstStop() (prev AstPrevState) {
 	}
 	i2cEnabled := a.I2cEnabledSet()
 	i2c := a.I2c
-	for i := 0; i < 14; i++ {
+	for i := 0; i < a.I2cBuses(); i++ {
 		base := a.I2cBase(i)
 		if i2cEnabled&(1<<uint(i)) != 0 && i2c.Read32(base+0) != 0 {
 			i2c.Write32(base+0, 0)
@@ -339,9 +347,11 @@ func (a *AstHandle) SpiInfo() {
 	}
 	//fmt.Printf("spiid = 0x%06x\n", fmc.spiId())
 	fmc0 := spi.Read32(0)
-	fmcA0 := spi.Read32(0xa0)
-	fmt.Printf("spi0=0x%x, writable=%d filter=%d\n", fmc0, bit(fmc0, 16), bit(fmcA0, 0))
-	fmt.Printf("\tEnables=0x%x\n", spi.Read32(0xA0))
+	filter := writeFilter(spi)
+	fmt.Printf("spi0=0x%x, writable=%d filter=%d\n", fmc0, bit(fmc0, 16), len(filter))
+	for _, r := range filter {
+		fmt.Printf("\twrite filter %s (writes are dropped)\n", r)
+	}
 	if fmc0&3 != 2 {
 		log.Fatal("FMC/CE0 !")
 	}
@@ -351,6 +361,17 @@ func (a *AstHandle) SpiInfo() {
 	fmc10 := spi.Read32(0x10)
 	fmt.Printf("iomode=0x%x cmd=0x%x\n", bits(fmc10, 28, 3), bits(fmc10, 16, 8))
 
+	for cs := 0; cs < a.FmcNumCs(); cs++ {
+		start, end := a.fmcSegment(spi.Read32(FMC_CE0SEG+int64(4*cs)), FMC_MEM)
+		fmt.Printf("CE%d: type=%d writable=%d addr4B=%d ctl=0x%08x window=0x%08x-0x%08x\n",
+			cs, bits(fmc0, uint8(2*cs), 2), bit(fmc0, uint8(16+cs)), bit(fmc4, uint8(cs)),
+			spi.Read32(FMC_CE0CTL+int64(4*cs)), FMC_MEM+start, FMC_MEM+end)
+	}
+	if a.Family <= 25 {
+		// WDT2 timeout status, bit 1: booted from second flash (CE1) after failover
+		fmt.Printf("boot-from-second-flash=%d\n", bit(a.wdt.Read32(0x30), 1))
+	}
+
 	for _, r := range spiRegs {
 		val := spi.Read32(r.Off)
 		for _, f := range r.Fields {
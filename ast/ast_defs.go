@@ -7,12 +7,15 @@ const (
 	I2C_ADDR  = 0x1E78A000
 	LPC_ADDR  = 0x1E789000
 	FMC_ADDR  = 0x1E620000
+	SPI1_ADDR = 0x1E630000
 	MAC0_ADDR = 0x1E660000
 	MAC1_ADDR = 0x1E680000
 
 	FMC_CE0CTL = 0x10
+	FMC_CE0SEG = 0x30
 
-	FMC_MEM = 0x20000000
+	FMC_MEM  = 0x20000000
+	SPI1_MEM = 0x30000000
 
 	DRAM_ADDR = 0x80000000
 
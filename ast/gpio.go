@@ -0,0 +1,31 @@
+package ast
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Data value registers for gpio groups of 4 banks (ABCD, EFGH, IJKL, ...)
+var gpioDataRegs = []int64{0x000, 0x020, 0x070, 0x078, 0x080, 0x088, 0x1e0}
+
+// Value of gpio named like "B6" or "AA3".
+func (a *AstHandle) GpioValue(name string) (int, error) {
+	if len(name) < 2 {
+		return 0, fmt.Errorf("bad gpio name \"%s\"", name)
+	}
+	bank := int(name[0] - 'A')
+	pinStr := name[1:]
+	if len(name) == 3 && name[1] >= 'A' && name[1] <= 'Z' {
+		bank = 26 + int(name[1]-'A')
+		pinStr = name[2:]
+	}
+	pin, err := strconv.Atoi(pinStr)
+	if err != nil || pin > 7 || bank < 0 || bank/4 >= len(gpioDataRegs) {
+		return 0, fmt.Errorf("bad gpio name \"%s\"", name)
+	}
+	if a.gpio == nil {
+		a.gpio = Map("gpio", GPIO_ADDR, false, 4096)
+	}
+	val := a.gpio.Read32(gpioDataRegs[bank/4])
+	return int(bit(val, uint8(8*(bank%4)+pin))), nil
+}
@@ -0,0 +1,69 @@
+package ast
+
+import (
+	"fmt"
+	"log"
+)
+
+// Switch the host SPI interface to BMC master mode, returns a function restoring previous mode.
+func (a *AstHandle) hostSpiMaster() func() {
+	if a.Family != 25 {
+		log.Printf("AST%d00: strap switching not supported, assuming host spi is already in master mode\n", a.Family)
+		return func() {}
+	}
+	scu := a.scu
+	// scu70[13:12]: 0 == disabled, 1 == master, 2 == master+pass-through, 3 == pass-through
+	scu.Write32(0, 0x1688a8a8)
+	prev := scu.Read32(0x70) & 0x3000
+	if prev == 0x1000 {
+		return func() {}
+	}
+	log.Printf("Switching host spi from mode %d to master\n", prev>>12)
+	scu.Write32(0x7c, 0x3000) // writing scu7c clears strap bits
+	scu.Write32(0x70, 0x1000)
+	return func() {
+		log.Printf("Restoring host spi mode %d\n", prev>>12)
+		scu.Write32(0, 0x1688a8a8)
+		scu.Write32(0x7c, 0x3000)
+		scu.Write32(0x70, prev)
+	}
+}
+
+// Access the host BIOS flash through the SPI1 (n == 1) or SPI2 (n == 2) master controller.
+// The host must not be running from that flash while it is switched to the BMC.
+func (a *AstHandle) HostSpiNew(n int) *Fmc {
+	if a.Family != 25 && a.Family != 26 {
+		log.Fatalf("Host spi access only supported on AST2[56]00\n")
+	}
+	var memAddr int64
+	switch {
+	case n == 1:
+		memAddr = SPI1_MEM
+	case n == 2 && a.Family == 25:
+		memAddr = 0x38000000
+	case n == 2 && a.Family == 26:
+		memAddr = 0x50000000
+	default:
+		log.Fatalf("Invalid host spi controller %d\n", n)
+	}
+	restore := a.hostSpiMaster()
+	f := a.spiNew(fmt.Sprintf("spi%d", n), SPI1_ADDR+int64(n-1)*0x1000, memAddr, 0)
+	f.restore = restore
+	return f
+}
+
+// Release the flash (restores host spi mode for HostSpiNew).
+func (f *Fmc) Close() {
+	if f.qeRestore != nil {
+		f.qeRestore()
+		f.qeRestore = nil
+	}
+	if f.restore != nil {
+		f.restore()
+		f.restore = nil
+	}
+	if f.trace != nil {
+		f.trace.f.Close()
+		f.trace = nil
+	}
+}
@@ -19,54 +19,176 @@ type i2cBus struct {
 	bus      int
 	bytes    int
 	starting bool
+	timeout  time.Duration
+	mode     int // i2cModeByte...
+	pool     int64
+	poolSize int
+	dma      pmem.Region
+	dmaAddr  int64
 }
 
 func (i *i2cBus) String() string {
 	return fmt.Sprintf("asti2c-%d", i.bus)
 }
 
+// Number of times a transaction is retried after a bus error and recovery (NACKs are not retried).
+var I2cRetries = 2
+
+const (
+	i2cCmdStart   = 0x01
+	i2cCmdTx      = 0x02
+	i2cCmdRx      = 0x08
+	i2cCmdRxLast  = 0x10
+	i2cCmdStop    = 0x20
+	i2cCmdRecover = 1 << 11
+
+	i2cBusBusy = 1 << 16
+	i2cSDA     = 1 << 17 // line status
+	i2cSCL     = 1 << 18
+
+	i2cStsRecoverDone = 1 << 13
+)
+
+type nackError struct {
+	msg string
+}
+
+func (e *nackError) Error() string {
+	return e.msg
+}
+
+func isNack(err error) bool {
+	_, ok := err.(*nackError)
+	return ok
+}
+
+// Start and address the slave, write w, and switch to read mode if read.
+func (i *i2cBus) begin(addr uint16, w []byte, read bool) error {
+	i.bytes = 0
+	if err := i.Start(false); err != nil {
+		return err
+	}
+	// a NACK leaves the bus in a sane state, just release it
+	fail := func(err error) error {
+		if isNack(err) {
+			if err2 := i.Stop(); err2 != nil {
+				return err2
+			}
+		}
+		return err
+	}
+	if len(w) > 0 {
+		if err := i.TxByte(byte(addr * 2)); err != nil {
+			return fail(err)
+		}
+		if err := i.tx(w); err != nil {
+			return fail(err)
+		}
+	}
+	if read {
+		if len(w) > 0 {
+			if err := i.Start(true); err != nil {
+				return err
+			}
+		}
+		if err := i.TxByte(byte(addr*2) + 1); err != nil {
+			return fail(err)
+		}
+	} else if len(w) == 0 {
+		// quick write: address only
+		if err := i.TxByte(byte(addr * 2)); err != nil {
+			return fail(err)
+		}
+	}
+	return nil
+}
+
+type i2cRecoverer interface {
+	String() string
+	Recover() error
+}
+
+// Run a transaction, recovering the bus after errors other than NACKs, and retrying.
+func i2cRetry(i i2cRecoverer, tx func() error) error {
+	var err error
+	for n := 0; n <= I2cRetries; n++ {
+		if err = tx(); err == nil || isNack(err) {
+			return err
+		}
+		log.Printf("%s: %s, recovering bus\n", i, err)
+		if rerr := i.Recover(); rerr != nil {
+			return fmt.Errorf("%s (recovery failed: %s)", err, rerr)
+		}
+	}
+	return err
+}
+
 func (i *i2cBus) Tx(addr uint16, w, r []byte) error {
 	if Verbose {
 		fmt.Printf("slave:0x%02x w=%02x r%d\n", addr, w, len(r))
 	}
-	i.bytes = 0
-	i.Start(false)
-	if len(w) > 0 {
-		err := i.TxByte(byte(addr * 2))
-		if err != nil {
-			i.Stop()
+	return i2cRetry(i, func() error {
+		if err := i.begin(addr, w, len(r) > 0); err != nil {
 			return err
 		}
-		for _, b := range w {
-			err = i.TxByte(b)
-			if err != nil {
-				i.Stop()
-				return err
-			}
+		if err := i.rx(r); err != nil {
+			return err
 		}
+		return i.Stop()
+	})
+}
 
+// SMBus block read: the first byte read is the count of following bytes, plus extra (PEC).
+func (i *i2cBus) TxBlock(addr uint16, w []byte, extra int) ([]byte, error) {
+	if Verbose {
+		fmt.Printf("slave:0x%02x w=%02x block+%d\n", addr, w, extra)
 	}
-	if len(r) > 0 {
-		if len(w) > 0 {
-			i.Start(true)
+	var r []byte
+	err := i2cRetry(i, func() error {
+		if err := i.begin(addr, w, true); err != nil {
+			return err
 		}
-		i.TxByte(byte(addr*2) + 1)
-		for n, _ := range r {
-			r[n] = i.RxByte(n == len(r)-1)
+		n, err := i.RxByte(false)
+		if err != nil {
+			return err
 		}
+		r = make([]byte, 1+int(n)+extra)
+		r[0] = n
+		if err := i.rx(r[1:]); err != nil {
+			return err
+		}
+		if len(r) == 1 {
+			// empty block: the last byte read must be nacked
+			if _, err := i.RxByte(true); err != nil {
+				return err
+			}
+		}
+		return i.Stop()
+	})
+	if err != nil {
+		return nil, err
 	}
-	i.Stop()
-	return nil
+	return r, nil
+}
+
+func (i *i2cBus) SetTimeout(d time.Duration) time.Duration {
+	prev := i.timeout
+	i.timeout = d
+	return prev
 }
 
 func (i *i2cBus) SetSpeed(f physic.Frequency) error {
 	return nil
 }
 
-func (a *AstHandle) I2cDev(busno, slave int) i2c.Dev {
+// Master access to a BMC i2c bus.
+func (a *AstHandle) I2cBus(busno int) i2c.Bus {
+	if a.Family >= 26 {
+		return a.i2cBus26(busno)
+	}
 	bus := &i2cBus{m: a.I2c, bus: busno, base: a.I2cBase(busno)}
 	if bus.m.Read32(bus.base+0x14) != 0x0a060000 {
-		bus.m.Write32(bus.base+0x14, 1<<11)
+		bus.m.Write32(bus.base+0x14, i2cCmdRecover)
 		time.Sleep(50 * time.Millisecond)
 		bus.m.Write32(bus.base+0, 0)
 		time.Sleep(100 * time.Millisecond)
@@ -82,94 +204,158 @@ func (a *AstHandle) I2cDev(busno, slave int) i2c.Dev {
 		log.Fatalf("Cannot initialize i2c, cmd = 0x%08x\n", bus.m.Read32(bus.base+0x14))
 	}
 	bus.m.Write32(bus.base, 1) // enable master func
-	return i2c.Dev{Bus: bus, Addr: uint16(slave)}
+	a.i2cBufInit(bus)
+	return bus
 }
 
-func (i *i2cBus) Wait(op string) {
+func (a *AstHandle) I2cDev(busno, slave int) i2c.Dev {
+	return i2c.Dev{Bus: a.I2cBus(busno), Addr: uint16(slave)}
+}
+
+func (i *i2cBus) Wait(op string) error {
 	t := time.Now()
+	timeout := i.timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
 	for cmd := i.m.Read32(i.base + 0x14); cmd&0x3ff != 0; cmd = i.m.Read32(i.base + 0x14) {
 		runtime.Gosched()
-		if time.Now().After(t.Add(time.Second)) {
+		if time.Now().After(t.Add(timeout)) {
 			sts := i.m.Read32(i.base + 0x10)
-			i.m.Write32(i.base+0, 0)
-			log.Fatalf("Timeout on i2c bus during %s, cmd=0x%08x, sts=0x%08x", op, cmd, sts)
+			return fmt.Errorf("%s: timeout during %s, cmd=0x%08x, sts=0x%08x", i, op, cmd, sts)
 		}
 	}
 	time.Sleep(50 * time.Microsecond)
+	return nil
 }
 
-func (i *i2cBus) Start(repeat bool) {
+func (i *i2cBus) Start(repeat bool) error {
 	i.starting = true
 	cmd := i.m.Read32(i.base + 0x14)
 	if !(cmd == 0x0a060000 && !repeat) && !(cmd == 0x0c430000 && repeat) && !(repeat && !ExtraCheck) {
-		log.Fatalf("%s: Start when non-idle: repeat=%t, st=0x%08x", i, repeat, cmd)
+		return fmt.Errorf("%s: Start when non-idle: repeat=%t, st=0x%08x", i, repeat, cmd)
+	}
+	i.m.Write32(i.base+0x14, i2cCmdStart)
+	if err := i.Wait("start"); err != nil {
+		return err
 	}
-	i.m.Write32(i.base+0x14, 1)
-	i.Wait("start")
 	sts := i.m.Read32(i.base + 0x10)
 	if sts != 0 {
-		log.Fatalf("Start: sts == 0x%08x\n", sts)
+		return fmt.Errorf("%s: Start: sts == 0x%08x", i, sts)
 	}
+	return nil
 }
 
-func (i *i2cBus) TxByte(b byte) error {
+func (i *i2cBus) txCheck() error {
 	cmd := i.m.Read32(i.base + 0x14)
 	if !(cmd == 0x14410000 && i.starting) && !(cmd == 0x0c430000 && !i.starting) && ExtraCheck {
 		time.Sleep(100 * time.Microsecond)
 		cmd2 := i.m.Read32(i.base + 0x14)
-		log.Fatalf("%s: TxByte-%d with cmd=0x%08x 0x%08x 0x%08x", i, i.bytes, cmd, cmd2, i.m.Read32(i.base+0x10))
+		return fmt.Errorf("%s: TxByte-%d with cmd=0x%08x 0x%08x 0x%08x", i, i.bytes, cmd, cmd2, i.m.Read32(i.base+0x10))
 	}
 	i.starting = false
+	return nil
+}
+
+func (i *i2cBus) TxByte(b byte) error {
+	if err := i.txCheck(); err != nil {
+		return err
+	}
 	i.m.Write32(i.base+0x20, uint32(b))
-	i.m.Write32(i.base+0x14, 2)
-	i.Wait("txbyte")
+	i.m.Write32(i.base+0x14, i2cCmdTx)
+	if err := i.Wait("txbyte"); err != nil {
+		return err
+	}
 	sts := i.m.Read32(i.base + 0x10)
 	i.m.Write32(i.base+0x10, sts)
 	if sts&2 != 0 {
-		return fmt.Errorf("%s: TxByte-%02x (%d) was nacked (sts=0x%08x)\n", i, b, i.bytes, sts)
+		return &nackError{fmt.Sprintf("%s: TxByte-%02x (%d) was nacked (sts=0x%08x)", i, b, i.bytes, sts)}
 	}
 	if sts != 1 {
-		log.Fatalf("TxByte-%d: sts == 0x%08x\n", i.bytes, sts)
+		return fmt.Errorf("%s: TxByte-%d: sts == 0x%08x", i, i.bytes, sts)
 	}
 	i.bytes += 1
 	return nil
 }
 
-func (i *i2cBus) RxByte(last bool) byte {
+func (i *i2cBus) rxCheck() error {
 	cmd := i.m.Read32(i.base + 0x14)
 	if !(cmd&^0x20000 == 0x0c410000) && ExtraCheck {
 		time.Sleep(200 * time.Microsecond)
 		cmd2 := i.m.Read32(i.base + 0x14)
-		log.Fatalf("%s: RxByte with cmd=0x%08x %08x %08x", i, cmd, cmd2, i.m.Read32(i.base+0x10))
+		return fmt.Errorf("%s: RxByte with cmd=0x%08x %08x %08x", i, cmd, cmd2, i.m.Read32(i.base+0x10))
+	}
+	return nil
+}
+
+func (i *i2cBus) RxByte(last bool) (byte, error) {
+	if err := i.rxCheck(); err != nil {
+		return 0, err
 	}
 	if last {
-		i.m.Write32(i.base+0x14, 0x18)
+		i.m.Write32(i.base+0x14, i2cCmdRx|i2cCmdRxLast)
 	} else {
-		i.m.Write32(i.base+0x14, 8)
+		i.m.Write32(i.base+0x14, i2cCmdRx)
+	}
+	if err := i.Wait("rxbyte"); err != nil {
+		return 0, err
 	}
-	i.Wait("rxbyte")
 	sts := i.m.Read32(i.base + 0x10)
 	b := i.m.Read32(i.base + 0x20)
 	//fmt.Printf("B%d:%04x\n", i.bytes, b)
 	b = b >> 8
 	if sts != 0x4 {
-		log.Fatalf("RxByte: sts == 0x%08x\n", sts)
+		return 0, fmt.Errorf("%s: RxByte-%d: sts == 0x%08x", i, i.bytes, sts)
 	}
 	i.m.Write32(i.base+0x10, sts)
 	i.bytes += 1
-	return byte(b)
+	return byte(b), nil
 }
 
-func (i *i2cBus) Stop() {
+func (i *i2cBus) Stop() error {
 	cmd := i.m.Read32(i.base + 0x14)
 	if !(cmd&^0x20000 == 0x0c410000) && ExtraCheck {
-		log.Fatalf("%s: Stop with st=0x%08x", i, cmd)
+		return fmt.Errorf("%s: Stop with st=0x%08x", i, cmd)
+	}
+	i.m.Write32(i.base+0x14, i2cCmdStop)
+	if err := i.Wait("stop"); err != nil {
+		return err
 	}
-	i.m.Write32(i.base+0x14, 0x20)
-	i.Wait("stop")
 	sts := i.m.Read32(i.base + 0x10)
 	if sts != 0x10 {
-		log.Fatalf("stop: sts == 0x%08x\n", sts)
+		return fmt.Errorf("%s: Stop: sts == 0x%08x", i, sts)
 	}
 	i.m.Write32(i.base+0x10, sts)
+	return nil
+}
+
+// Bring the bus back to idle after an error: STOP if the controller still owns the bus,
+// the bus-recovery command (clocks SCL until the slave releases SDA) if SDA is held low,
+// then a controller reset.
+func (i *i2cBus) Recover() error {
+	cmd := i.m.Read32(i.base + 0x14)
+	i.m.Write32(i.base+0x10, i.m.Read32(i.base+0x10))
+	switch {
+	case cmd&i2cSCL == 0:
+		log.Printf("%s: SCL held low (cmd=0x%08x), only resetting the controller\n", i, cmd)
+	case cmd&i2cSDA == 0:
+		i.m.Write32(i.base+0x14, i2cCmdRecover)
+		t := time.Now()
+		for i.m.Read32(i.base+0x10)&i2cStsRecoverDone == 0 && time.Since(t) < 100*time.Millisecond {
+			runtime.Gosched()
+		}
+	case cmd&i2cBusBusy != 0:
+		i.m.Write32(i.base+0x14, i2cCmdStop)
+		_ = i.Wait("recovery stop")
+	}
+	fun := i.m.Read32(i.base + 0)
+	i.m.Write32(i.base+0, 0)
+	time.Sleep(time.Millisecond)
+	i.m.Write32(i.base+0, fun|1)
+	i.m.Write32(i.base+0x10, i.m.Read32(i.base+0x10))
+	i.starting = false
+	if cmd := i.m.Read32(i.base + 0x14); cmd != 0x0a060000 {
+		return fmt.Errorf("%s: bus not idle after recovery, cmd=0x%08x", i, cmd)
+	}
+	return nil
 }
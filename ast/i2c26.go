@@ -0,0 +1,323 @@
+package ast
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"time"
+
+	"github.com/lprylli/hwmisc/pmem"
+	"periph.io/x/periph/conn/physic"
+)
+
+// AST2600 new register mode: each master command is a packet (start, address, data
+// through the 32-byte buffer of the bus, stop) completed in the interrupt status register.
+const (
+	i2cgCtrl      = 0x0c // global control
+	i2cgNewReg    = 1 << 2
+	i2cgNewClkDiv = 1 << 1
+
+	// per bus
+	i2ccFunCtrl = 0x00
+	i2ccStsBuf  = 0x08 // line status, byte buffer
+	i2ccBufCtrl = 0x0c
+	i2cmIsr     = 0x14
+	i2cmCmd     = 0x18
+
+	i2ccMasterEn = 1 << 0
+
+	// I2CC08 line status, also decoded by the i2c monitor
+	I2ccBusBusy = 1 << 16
+	I2ccSDA     = 1 << 25
+	I2ccSCL     = 1 << 24
+
+	i2cmPktEn      = 1 << 16
+	i2cmRecoverCmd = 1 << 11
+	i2cmRxBufEn    = 1 << 7
+	i2cmTxBufEn    = 1 << 6
+	i2cmStop       = 1 << 5
+	i2cmRxLast     = 1 << 4
+	i2cmRx         = 1 << 3
+	i2cmTx         = 1 << 1
+	i2cmStart      = 1 << 0
+
+	i2cmIsrPktTimeout        = 1 << 18
+	i2cmIsrPktError          = 1 << 17
+	i2cmIsrPktDone           = 1 << 16
+	i2cmIsrRecoverFail       = 1 << 15
+	i2cmIsrRecoverDone       = 1 << 13
+	i2cmIsrSclLowTo          = 1 << 6
+	i2cmIsrAbnormal          = 1 << 5
+	i2cmIsrArbitLoss         = 1 << 3
+	i2cmIsrTxNak             = 1 << 1
+	i2cmIsrErrors            = i2cmIsrPktTimeout | i2cmIsrPktError | i2cmIsrSclLowTo | i2cmIsrAbnormal | i2cmIsrArbitLoss
+	i2cPoolSize26            = 32
+	i2cPoolBase26      int64 = 0xc00
+)
+
+// Switch an AST2600 controller in legacy register mode to new mode. This changes the
+// register layout and clock divider of all 16 buses, under the feet of the BMC firmware.
+var I2cSwitchNewMode bool
+
+type i2cBus26 struct {
+	m       pmem.Region
+	base    int64
+	pool    int64
+	bus     int
+	chunk   int
+	timeout time.Duration
+}
+
+func (i *i2cBus26) String() string {
+	return fmt.Sprintf("asti2c-%d", i.bus)
+}
+
+func (a *AstHandle) i2cBus26(busno int) *i2cBus26 {
+	bus := &i2cBus26{m: a.I2c, bus: busno, base: a.I2cBase(busno), pool: i2cPoolBase26 + int64(busno)*i2cPoolSize26, chunk: i2cPoolSize26}
+	if I2cMode == "byte" {
+		bus.chunk = 1
+	}
+	if g := a.I2c.Read32(i2cgCtrl); g&i2cgNewReg == 0 {
+		if !I2cSwitchNewMode {
+			log.Fatalf("i2c controller in legacy register mode (0x%08x), only new mode is supported: switching affects all buses, see -i2cnewmode\n", g)
+		}
+		log.Printf("i2c controller in legacy register mode (0x%08x), switching all buses to new mode\n", g)
+		a.I2c.Write32(i2cgCtrl, g|i2cgNewReg|i2cgNewClkDiv)
+	}
+	if en := a.I2cEnabledSet(); en&(1<<uint(busno)) == 0 {
+		a.i2cPinEnable26(busno)
+		log.Printf("i2c %d pins were disabled, enabling...\n", busno)
+	}
+	if bus.m.Read32(bus.base+0x04) == 0 {
+		log.Printf("%s: AC timing not programmed, bus speed is undefined\n", bus)
+	}
+	bus.m.Write32(bus.base+i2ccFunCtrl, bus.m.Read32(bus.base+i2ccFunCtrl)|i2ccMasterEn)
+	if err := bus.idle(); err != nil {
+		if err := bus.Recover(); err != nil {
+			log.Fatalf("Cannot initialize i2c: %s\n", err)
+		}
+	}
+	return bus
+}
+
+// True on AST2600 controllers in new register mode.
+func (a *AstHandle) I2cNewMode() bool {
+	return a.Family >= 26 && a.I2c.Read32(i2cgCtrl)&i2cgNewReg != 0
+}
+
+// AST2600 SCL pin function enables (SCU offset and bit, SDA is the next bit), per bus.
+var i2cPins26 = [16]struct {
+	reg int64
+	bit uint
+}{
+	{0x418, 8}, {0x418, 10}, {0x418, 12}, {0x418, 14}, {0x418, 16}, {0x418, 18}, {0x418, 20}, {0x418, 22},
+	{0x418, 24}, {0x418, 26}, {0x418, 28}, {0x418, 30}, {0x4b8, 0}, {0x4b8, 2}, {0x4b8, 4}, {0x4b8, 6},
+}
+
+func (a *AstHandle) i2cEnabledSet26() (en uint32) {
+	for n, p := range i2cPins26 {
+		if a.scu.Read32(p.reg)>>p.bit&3 == 3 {
+			en |= 1 << uint(n)
+		}
+	}
+	return en
+}
+
+func (a *AstHandle) i2cPinEnable26(busno int) {
+	p := i2cPins26[busno]
+	a.scu.Write32(0, 0x1688a8a8)
+	a.scu.Write32(p.reg, a.scu.Read32(p.reg)|3<<p.bit)
+}
+
+func (i *i2cBus26) idle() error {
+	if sts := i.m.Read32(i.base + i2ccStsBuf); sts&(I2ccSDA|I2ccSCL) != I2ccSDA|I2ccSCL || sts&I2ccBusBusy != 0 {
+		return fmt.Errorf("%s: bus not idle, sts=0x%08x", i, sts)
+	}
+	return nil
+}
+
+// Issue one master command, and wait for completion.
+func (i *i2cBus26) cmd(cmd uint32, op string) (uint32, error) {
+	i.m.Write32(i.base+i2cmIsr, i.m.Read32(i.base+i2cmIsr))
+	i.m.Write32(i.base+i2cmCmd, cmd)
+	timeout := i.timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	done := uint32(i2cmIsrPktDone)
+	if cmd&i2cmRecoverCmd != 0 {
+		done = i2cmIsrRecoverDone | i2cmIsrRecoverFail
+	}
+	t := time.Now()
+	for {
+		isr := i.m.Read32(i.base + i2cmIsr)
+		if isr&done != 0 {
+			i.m.Write32(i.base+i2cmIsr, isr)
+			return isr, nil
+		}
+		if time.Since(t) > timeout {
+			return isr, fmt.Errorf("%s: timeout during %s, cmd=0x%08x, isr=0x%08x, sts=0x%08x", i, op, cmd, isr, i.m.Read32(i.base+i2ccStsBuf))
+		}
+		runtime.Gosched()
+	}
+}
+
+// One packet: start (first), address, data out (w) or in (r), stop (last).
+func (i *i2cBus26) packet(addr uint16, w []byte, r []byte, first, last bool) error {
+	cmd := uint32(i2cmPktEn) | uint32(addr&0x7f)<<24
+	if first {
+		cmd |= i2cmStart
+	}
+	if last {
+		cmd |= i2cmStop
+	}
+	switch {
+	case len(w) > 0:
+		for k := 0; k < len(w); k += 4 {
+			var v uint32
+			for j := 0; j < 4 && k+j < len(w); j++ {
+				v |= uint32(w[k+j]) << uint(8*j)
+			}
+			i.m.Write32(i.pool+int64(k), v)
+		}
+		i.m.Write32(i.base+i2ccBufCtrl, uint32(len(w)-1)<<8)
+		cmd |= i2cmTx | i2cmTxBufEn
+	case len(r) > 0:
+		i.m.Write32(i.base+i2ccBufCtrl, uint32(len(r)-1)<<16)
+		cmd |= i2cmRx | i2cmRxBufEn
+		if last {
+			cmd |= i2cmRxLast
+		}
+	}
+	isr, err := i.cmd(cmd, "packet")
+	switch {
+	case err != nil:
+		return err
+	case isr&i2cmIsrTxNak != 0:
+		// the controller issues the stop itself
+		return &nackError{fmt.Sprintf("%s: slave 0x%02x nacked (isr=0x%08x)", i, addr, isr)}
+	case isr&i2cmIsrErrors != 0:
+		return fmt.Errorf("%s: slave 0x%02x: isr=0x%08x, sts=0x%08x", i, addr, isr, i.m.Read32(i.base+i2ccStsBuf))
+	}
+	if len(r) > 0 {
+		if n := int(i.m.Read32(i.base+i2ccBufCtrl) >> 24 & 0x3f); n != len(r) {
+			return fmt.Errorf("%s: Rx of %d bytes: got %d", i, len(r), n)
+		}
+		for k := 0; k < len(r); k += 4 {
+			v := i.m.Read32(i.pool + int64(k))
+			for j := 0; j < 4 && k+j < len(r); j++ {
+				r[k+j] = byte(v >> uint(8*j))
+			}
+		}
+	}
+	return nil
+}
+
+// Address the slave and write w (or nothing: quick write), then read r after a repeated start.
+func (i *i2cBus26) tx(addr uint16, w, r []byte) error {
+	first := true
+	if len(w) > 0 || len(r) == 0 {
+		for k := 0; k == 0 || k < len(w); k += i.chunk {
+			end := k + i.chunk
+			if end > len(w) {
+				end = len(w)
+			}
+			if err := i.packet(addr, w[k:end], nil, first, end == len(w) && len(r) == 0); err != nil {
+				return err
+			}
+			first = false
+		}
+		first = true
+	}
+	for k := 0; k < len(r); k += i.chunk {
+		end := k + i.chunk
+		if end > len(r) {
+			end = len(r)
+		}
+		if err := i.packet(addr, nil, r[k:end], first, end == len(r)); err != nil {
+			return err
+		}
+		first = false
+	}
+	return nil
+}
+
+func (i *i2cBus26) Tx(addr uint16, w, r []byte) error {
+	if Verbose {
+		fmt.Printf("slave:0x%02x w=%02x r%d\n", addr, w, len(r))
+	}
+	return i2cRetry(i, func() error {
+		return i.tx(addr, w, r)
+	})
+}
+
+// SMBus block read: the first byte read is the count of following bytes, plus extra (PEC).
+func (i *i2cBus26) TxBlock(addr uint16, w []byte, extra int) ([]byte, error) {
+	if Verbose {
+		fmt.Printf("slave:0x%02x w=%02x block+%d\n", addr, w, extra)
+	}
+	var r []byte
+	err := i2cRetry(i, func() error {
+		if len(w) > 0 {
+			if err := i.packet(addr, w, nil, true, false); err != nil {
+				return err
+			}
+		}
+		n := make([]byte, 1)
+		if err := i.packet(addr, nil, n, true, false); err != nil {
+			return err
+		}
+		r = make([]byte, 1+int(n[0])+extra)
+		r[0] = n[0]
+		if len(r) == 1 {
+			// empty block: the last byte read must be nacked
+			return i.packet(addr, nil, make([]byte, 1), false, true)
+		}
+		for k := 1; k < len(r); k += i.chunk {
+			end := k + i.chunk
+			if end > len(r) {
+				end = len(r)
+			}
+			if err := i.packet(addr, nil, r[k:end], false, end == len(r)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (i *i2cBus26) SetTimeout(d time.Duration) time.Duration {
+	prev := i.timeout
+	i.timeout = d
+	return prev
+}
+
+func (i *i2cBus26) SetSpeed(f physic.Frequency) error {
+	return nil
+}
+
+// Same as the legacy Recover: STOP if the bus is busy, recovery command if SDA is held
+// low, then a controller reset.
+func (i *i2cBus26) Recover() error {
+	sts := i.m.Read32(i.base + i2ccStsBuf)
+	switch {
+	case sts&I2ccSCL == 0:
+		log.Printf("%s: SCL held low (sts=0x%08x), only resetting the controller\n", i, sts)
+	case sts&I2ccSDA == 0:
+		if isr, err := i.cmd(i2cmRecoverCmd, "recovery"); err == nil && isr&i2cmIsrRecoverFail != 0 {
+			log.Printf("%s: bus recovery failed (isr=0x%08x)\n", i, isr)
+		}
+	case sts&I2ccBusBusy != 0:
+		_, _ = i.cmd(i2cmPktEn|i2cmStop, "recovery stop")
+	}
+	fun := i.m.Read32(i.base + i2ccFunCtrl)
+	i.m.Write32(i.base+i2ccFunCtrl, 0)
+	time.Sleep(time.Millisecond)
+	i.m.Write32(i.base+i2ccFunCtrl, fun|i2ccMasterEn)
+	i.m.Write32(i.base+i2cmIsr, i.m.Read32(i.base+i2cmIsr))
+	return i.idle()
+}
@@ -0,0 +1,200 @@
+package ast
+
+import (
+	"fmt"
+	"log"
+)
+
+// Transfer mode of multi-byte i2c master transfers: "byte" (one command per byte),
+// "pool" (buffer-pool) or "dma" (AST2400/2500).
+var I2cMode = "byte"
+
+// DRAM address of the DMA buffer, clobbered by "dma" transfers: must be memory the
+// running BMC firmware does not use, there is no safe default.
+var I2cDmaAddr int64
+
+const (
+	i2cCmdTxBuf = 1 << 6
+	i2cCmdRxBuf = 1 << 7
+	i2cCmdTxDma = 1 << 8
+	i2cCmdRxDma = 1 << 9
+
+	i2cDmaMax = 2048
+)
+
+const (
+	i2cModeByte = iota
+	i2cModePool
+	i2cModeDma
+)
+
+// Setup pool or dma mode of a bus.
+func (a *AstHandle) i2cBufInit(bus *i2cBus) {
+	switch {
+	case I2cMode == "byte" || a.Family >= 26:
+	case I2cMode == "pool" && a.Family == 25:
+		// 16 bytes per bus
+		bus.mode, bus.pool, bus.poolSize = i2cModePool, 0x200+16*int64(bus.bus), 16
+	case I2cMode == "pool":
+		// 256-byte page of the 2KB pool, as selected in the function control register
+		bus.mode, bus.pool, bus.poolSize = i2cModePool, 0x800+int64(bus.m.Read32(bus.base)>>20&7)*0x100, 0x100
+	case I2cMode == "dma":
+		addr := I2cDmaAddr
+		if addr == 0 {
+			log.Fatalf("i2c dma mode needs the DRAM address of a buffer unused by the BMC firmware\n")
+		}
+		if addr&3 != 0 {
+			log.Fatalf("i2c dma address 0x%x is not 4-byte aligned\n", addr)
+		}
+		bus.mode, bus.dmaAddr, bus.dma = i2cModeDma, addr, Map("i2cdma", addr, true, 4096)
+	default:
+		log.Fatalf("Unknown i2c mode \"%s\"\n", I2cMode)
+	}
+}
+
+func (i *i2cBus) chunk() int {
+	if i.mode == i2cModePool {
+		return i.poolSize
+	}
+	return i2cDmaMax
+}
+
+// Copy to/from pool or dma buffer, 32 bits at a time.
+func (i *i2cBus) bufWrite(b []byte) {
+	m, off := i.m, i.pool
+	if i.mode == i2cModeDma {
+		m, off = i.dma, 0
+	}
+	for k := 0; k < len(b); k += 4 {
+		var v uint32
+		for j := 0; j < 4 && k+j < len(b); j++ {
+			v |= uint32(b[k+j]) << uint(8*j)
+		}
+		m.Write32(off+int64(k), v)
+	}
+}
+
+func (i *i2cBus) bufRead(b []byte) {
+	m, off := i.m, i.pool
+	if i.mode == i2cModeDma {
+		m, off = i.dma, 0
+	}
+	for k := 0; k < len(b); k += 4 {
+		v := m.Read32(off + int64(k))
+		for j := 0; j < 4 && k+j < len(b); j++ {
+			b[k+j] = byte(v >> uint(8*j))
+		}
+	}
+}
+
+// Write data bytes after the address.
+func (i *i2cBus) tx(w []byte) error {
+	if i.mode == i2cModeByte || len(w) == 1 {
+		for _, b := range w {
+			if err := i.TxByte(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for len(w) > 0 {
+		n := len(w)
+		if n > i.chunk() {
+			n = i.chunk()
+		}
+		if err := i.txBuf(w[:n]); err != nil {
+			return err
+		}
+		w = w[n:]
+	}
+	return nil
+}
+
+// Read data bytes, the last one is nacked.
+func (i *i2cBus) rx(r []byte) error {
+	if i.mode == i2cModeByte || len(r) == 1 {
+		for n := range r {
+			var err error
+			if r[n], err = i.RxByte(n == len(r)-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for len(r) > 0 {
+		n := len(r)
+		if n > i.chunk() {
+			n = i.chunk()
+		}
+		if err := i.rxBuf(r[:n], n == len(r)); err != nil {
+			return err
+		}
+		r = r[n:]
+	}
+	return nil
+}
+
+func (i *i2cBus) txBuf(b []byte) error {
+	if err := i.txCheck(); err != nil {
+		return err
+	}
+	i.bufWrite(b)
+	cmd := uint32(i2cCmdTx)
+	if i.mode == i2cModePool {
+		i.m.Write32(i.base+0x1c, uint32(len(b)-1)<<8)
+		cmd |= i2cCmdTxBuf
+	} else {
+		i.m.Write32(i.base+0x24, uint32(i.dmaAddr))
+		i.m.Write32(i.base+0x28, uint32(len(b)))
+		cmd |= i2cCmdTxDma
+	}
+	i.m.Write32(i.base+0x14, cmd)
+	if err := i.Wait("txbuf"); err != nil {
+		return err
+	}
+	sts := i.m.Read32(i.base + 0x10)
+	i.m.Write32(i.base+0x10, sts)
+	if sts&2 != 0 {
+		return &nackError{fmt.Sprintf("%s: Tx of %d bytes (after %d) was nacked (sts=0x%08x)", i, len(b), i.bytes, sts)}
+	}
+	if sts != 1 {
+		return fmt.Errorf("%s: Tx of %d bytes (after %d): sts == 0x%08x", i, len(b), i.bytes, sts)
+	}
+	i.bytes += len(b)
+	return nil
+}
+
+func (i *i2cBus) rxBuf(b []byte, last bool) error {
+	if err := i.rxCheck(); err != nil {
+		return err
+	}
+	cmd := uint32(i2cCmdRx)
+	if last {
+		cmd |= i2cCmdRxLast
+	}
+	if i.mode == i2cModePool {
+		i.m.Write32(i.base+0x1c, uint32(len(b)-1)<<16)
+		cmd |= i2cCmdRxBuf
+	} else {
+		i.m.Write32(i.base+0x24, uint32(i.dmaAddr))
+		i.m.Write32(i.base+0x28, uint32(len(b)))
+		cmd |= i2cCmdRxDma
+	}
+	i.m.Write32(i.base+0x14, cmd)
+	if err := i.Wait("rxbuf"); err != nil {
+		return err
+	}
+	sts := i.m.Read32(i.base + 0x10)
+	if sts != 0x4 {
+		return fmt.Errorf("%s: Rx of %d bytes (after %d): sts == 0x%08x", i, len(b), i.bytes, sts)
+	}
+	i.m.Write32(i.base+0x10, sts)
+	if i.mode == i2cModePool {
+		if n := int(i.m.Read32(i.base+0x1c) >> 24 & 0xff); n != len(b) {
+			return fmt.Errorf("%s: Rx of %d bytes: got %d", i, len(b), n)
+		}
+	}
+	i.bufRead(b)
+	i.bytes += len(b)
+	return nil
+}
@@ -1,6 +1,7 @@
 package ast
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/lprylli/hwmisc/pci"
 	"github.com/lprylli/hwmisc/pmem"
@@ -110,6 +111,25 @@ func (m *AstMem) Write8(offset int64, val uint8) {
 
 }
 
+// Read a block of 32-bit words, taking the lock and setting the p2a window once per 64KB page.
+func (m *AstMem) ReadBlock(offset int64, b []byte) {
+	if offset+int64(len(b)) > m.size || len(b)&3 != 0 {
+		log.Printf("offset=%#x, len=%#x, %#v\n", offset, len(b), m)
+		panic("out of bounds")
+	}
+	offset += m.start
+	p2a := m.p2a
+	p2a.m.Lock()
+	defer p2a.m.Unlock()
+	for x := 0; x < len(b); x += 4 {
+		addr := offset + int64(x)
+		if x == 0 || addr&0xffff == 0 {
+			setIndex(p2a, addr)
+		}
+		binary.LittleEndian.PutUint32(b[x:], p2a.bar1.Read32(0x10000+addr&0xffff))
+	}
+}
+
 func (m *AstMem) Name() string { return m.name }
 
 func (m *AstMem) Mem() []byte {
@@ -0,0 +1,150 @@
+package ast
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+)
+
+// JESD216 Serial Flash Discoverable Parameters
+const (
+	RDSFDP        = 0x5a
+	sfdpSignature = 0x50444653 // "SFDP"
+	sfdpBFPT      = 0xff00     // Basic Flash Parameter Table
+	sfdp4BAIT     = 0xff84     // 4-byte Address Instruction Table
+)
+
+type spiErase struct {
+	Size     int64
+	op, op4b byte // op4b is 0 when the erase type has no 4B-address opcode
+}
+
+type sfdpParam struct {
+	id     uint16
+	rev    uint16 // major<<8 | minor
+	dwords int
+	ptr    uint32
+}
+
+func (fmc *Fmc) sfdpRead(addr uint32, size int) []byte {
+	size = (size + 3) &^ 3
+	out := []byte{RDSFDP, byte(addr >> 16), byte(addr >> 8), byte(addr), 0} // 8 dummy cycles
+	return fmc.spiXfer(out, int64(size))
+}
+
+func (fmc *Fmc) sfdpTable(p sfdpParam) []uint32 {
+	buf := fmc.sfdpRead(p.ptr, p.dwords*4)
+	dw := make([]uint32, p.dwords)
+	for i := range dw {
+		dw[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	return dw
+}
+
+// Build chip description from SFDP tables.
+func (fmc *Fmc) sfdpChip() (chip spiChip, err error) {
+	hdr := fmc.sfdpRead(0, 8)
+	if binary.LittleEndian.Uint32(hdr) != sfdpSignature {
+		return chip, fmt.Errorf("no SFDP signature (got %02x)", hdr[0:4])
+	}
+	nph := int(hdr[6]) + 1
+	raw := fmc.sfdpRead(8, nph*8)
+	params := make(map[uint16]sfdpParam)
+	for i := 0; i < nph; i++ {
+		p := raw[i*8 : i*8+8]
+		param := sfdpParam{
+			id:     uint16(p[7])<<8 | uint16(p[0]),
+			rev:    uint16(p[2])<<8 | uint16(p[1]),
+			dwords: int(p[3]),
+			ptr:    uint32(p[4]) | uint32(p[5])<<8 | uint32(p[6])<<16,
+		}
+		// several revisions of a table: use the highest one
+		if prev, ok := params[param.id]; !ok || param.rev > prev.rev {
+			params[param.id] = param
+		}
+	}
+	bfptParam, ok := params[sfdpBFPT]
+	if !ok || bfptParam.dwords < 9 {
+		return chip, fmt.Errorf("no usable SFDP basic flash parameter table")
+	}
+	chip.name = fmt.Sprintf("sfdp-%06x", fmc.id)
+	bfpt := fmc.sfdpTable(bfptParam)
+	chip.sfdp = bfpt
+
+	// dword 2: density
+	if bfpt[1]&0x80000000 != 0 {
+		chip.Size = int64(1) << (bfpt[1] & 0x7fffffff) / 8
+	} else {
+		chip.Size = (int64(bfpt[1]) + 1) / 8
+	}
+
+	// dword 8-9: erase types
+	for i := uint(0); i < 4; i++ {
+		v := bfpt[7+i/2] >> (16 * (i % 2))
+		if v&0xff == 0 {
+			continue
+		}
+		chip.erases = append(chip.erases, spiErase{Size: 1 << (v & 0xff), op: byte(v >> 8)})
+	}
+	if len(chip.erases) == 0 {
+		return chip, fmt.Errorf("SFDP: no erase type")
+	}
+
+	// dword 16: 4B address mode entry/exit methods
+	if len(bfpt) >= 16 {
+		chip.enter4B = uint8(bfpt[15] >> 24)
+		chip.exit4B = uint16(bfpt[15]>>14) & 0x3ff
+		chip.mx3b4b = chip.enter4B&0x01 != 0 && chip.exit4B&0x01 != 0 // plain b7/e9
+		chip.op4b = chip.enter4B&0x20 != 0
+	}
+	for i := range chip.erases {
+		if chip.op4b {
+			chip.erases[i].op4b = std4BErase[chip.erases[i].op]
+		}
+	}
+	if p, ok := params[sfdp4BAIT]; ok && p.dwords >= 2 {
+		ait := fmc.sfdpTable(p)
+		// fast-read 0x0c and page-program 0x12
+		chip.op4b = ait[0]&0x2 != 0 && ait[0]&0x40 != 0
+		n := 0
+		for i := uint(0); i < 4; i++ {
+			if bfpt[7+i/2]>>(16*(i%2))&0xff == 0 {
+				continue
+			}
+			if ait[0]&(1<<(9+i)) != 0 {
+				chip.erases[n].op4b = byte(ait[1] >> (8 * i))
+			}
+			n++
+		}
+	}
+	sortErases(chip.erases)
+
+	// prefer 64K erase, otherwise the largest available
+	e := chip.erases[len(chip.erases)-1]
+	for _, x := range chip.erases {
+		if x.Size == 64*1024 {
+			e = x
+		}
+	}
+	chip.EraseSize = e.Size
+	chip.eraseOp, chip.eraseOp4b = e.op, e.op4b
+	if chip.op4b && chip.eraseOp4b == 0 {
+		chip.op4b = false
+	}
+	if Verbose {
+		log.Printf("SFDP: %s size=%#x erases=%v 4B-ops=%t enter4B=%#x exit4B=%#x\n",
+			chip.name, chip.Size, chip.erases, chip.op4b, chip.enter4B, chip.exit4B)
+	}
+	return chip, nil
+}
+
+// Erase opcode with 4B address for the legacy 3B opcode.
+var std4BErase = map[byte]byte{0x20: 0x21, 0x52: 0x5c, ERASE: ERASE4B}
+
+func sortErases(e []spiErase) {
+	for i := 1; i < len(e); i++ {
+		for j := i; j > 0 && e[j].Size < e[j-1].Size; j-- {
+			e[j], e[j-1] = e[j-1], e[j]
+		}
+	}
+}
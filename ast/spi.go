@@ -1,6 +1,7 @@
 package ast
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"github.com/lprylli/hwmisc/pmem"
@@ -9,6 +10,7 @@ import (
 )
 
 var SpiMode int
+var SpiCs int
 
 type spiChip struct {
 	name      string
@@ -16,16 +18,32 @@ type spiChip struct {
 	EraseSize int64
 	op4b      bool
 	mx3b4b    bool
+	// from SFDP when available
+	sfdp               []uint32   // basic flash parameter table
+	erases             []spiErase // smallest first
+	eraseOp, eraseOp4b byte       // opcodes for EraseSize
+	enter4B            uint8      // BFPT dword16 4B-address entry methods
+	exit4B             uint16     // BFPT dword16 4B-address exit methods
 }
 
 type Fmc struct {
-	mem                  *AstMem
+	mem                  pmem.Region // window of the chip select
+	memSize              int64
 	reg                  pmem.Region
+	cs                   int
+	ctl                  int64 // CEx control register
 	ce0CtlSlow           uint32
 	ce0CtlFast           uint32
 	id                   uint32
 	Chip                 spiChip
 	read, program, erase byte
+	addr4B               bool // chip and controller in 4B-address mode
+	prot                 SpiProt
+	qe                   int // I/O mode enabled on the chip (QE bit for quad)
+	maxIO                int // widest data bus of the controller
+	qeRestore            func()
+	trace                *spiTrace
+	restore              func()
 }
 
 const (
@@ -52,7 +70,7 @@ func (f *Fmc) Sel(cmd byte) uint32 {
 
 func (fmc *Fmc) spiXfer(out []byte, inSize int64) []byte {
 	buf := make([]byte, inSize)
-	fmc.reg.Write32(FMC_CE0CTL, fmc.Sel(out[0])|0x0003)
+	fmc.reg.Write32(fmc.ctl, fmc.Sel(out[0])|0x0003)
 	firstBytes := len(out) & 3
 	var s string
 	if false {
@@ -68,21 +86,29 @@ func (fmc *Fmc) spiXfer(out []byte, inSize int64) []byte {
 		fmc.mem.Write32(0, binary.LittleEndian.Uint32(out[x:]))
 	}
 	for x := int64(0); x < inSize; x += 4 {
-		val := fmc.mem.Read32(x)
+		// in user mode, any address within the window accesses the chip
+		val := fmc.mem.Read32(x % fmc.memSize)
 		binary.LittleEndian.PutUint32(buf[x:], val)
 	}
-	fmc.reg.Write32(FMC_CE0CTL, fmc.Sel(out[0])|0x0007)
+	fmc.reg.Write32(fmc.ctl, fmc.Sel(out[0])|0x0007)
+	if fmc.trace != nil {
+		fmc.traceXfer(out, buf)
+	}
 	return buf
 }
 
+// Opcodes that always take a 4-byte address
+var op4B = map[byte]bool{FREAD4B: true, PPROGRAM4B: true, ERASE4B: true, 0x13: true, 0x21: true, 0x5c: true,
+	0x3c: true, 0x6c: true, 0xbc: true, 0xec: true, 0x34: true, 0x3e: true}
+
 func (fmc *Fmc) spiXferAddr(cmd byte, off uint32, extra []byte, inSize int64) []byte {
 	var out []byte
-	if SpiMode == 4 || cmd == FREAD4B || cmd == PPROGRAM4B || cmd == ERASE4B {
+	if fmc.addr4B || op4B[cmd] {
 		out = make([]byte, 5+len(extra))
 		binary.BigEndian.PutUint32(out[1:], uint32(off))
 		out[0] = cmd
 		copy(out[5:], extra)
-	} else if SpiMode == 3 && (cmd == FREAD || cmd == PPROGRAM || cmd == ERASE) {
+	} else {
 		if off&^0xffffff != 0 {
 			log.Fatalf("spiXferAddr3B (cmd=%#x, offset=%#x)\n", cmd, off)
 		}
@@ -90,28 +116,77 @@ func (fmc *Fmc) spiXferAddr(cmd byte, off uint32, extra []byte, inSize int64) []
 		binary.BigEndian.PutUint32(out[0:], uint32(off))
 		out[0] = cmd
 		copy(out[4:], extra)
-	} else {
-		log.Fatalf("SpiXferAddr(cmd=%#x, offset=%#x): Unknown addr size (mode=%d)\n", cmd, off, SpiMode)
 	}
 	return fmc.spiXfer(out, inSize)
 }
 
-/*
-check fast-read config before reenable
-// Reads SPI using fast-read command.
+// Force reads through user mode instead of the memory-mapped window.
+var SpiUserRead bool
+
+type blockReader interface {
+	ReadBlock(offset int64, b []byte)
+}
+
+func readBlock(r pmem.Region, off int64, b []byte) {
+	if br, ok := r.(blockReader); ok {
+		br.ReadBlock(off, b)
+		return
+	}
+	for x := 0; x < len(b); x += 4 {
+		binary.LittleEndian.PutUint32(b[x:], r.Read32(off+int64(x)))
+	}
+}
+
+// Reads SPI through the chip select window, with the controller in fast-read mode.
+// Returns nil when the range cannot be accessed that way.
 func (fmc *Fmc) SpiReadMapped(off, size int64) []byte {
-	var b = make([]byte, size)
-	fmc.reg.Write32(FMC_CE0CTL, fmc.ce0CtlFast|0x0b0041)
-	for x := int64(0); x < size; x += 4 {
-		val := fmc.mem.Read32(off + x)
-		binary.LittleEndian.PutUint32(b[off+x:], val)
+	if off+size > fmc.memSize || off&3 != 0 {
+		return nil
 	}
-	return b
+	cmd, io := fmc.readMode()
+	ctl4B := fmc.reg.Read32(0x04)
+	if !fmc.addr4B && off+size > 1<<24 {
+		if !fmc.Chip.op4b {
+			return nil
+		}
+		// 4B-address opcode, the controller must send 4 address bytes
+		cmd = fread4B[cmd]
+		fmc.reg.Write32(0x04, ctl4B|1<<uint(fmc.cs))
+		defer fmc.reg.Write32(0x04, ctl4B)
+	}
+	ctl := fmc.reg.Read32(fmc.ctl)
+	defer fmc.reg.Write32(fmc.ctl, ctl)
+	// fast-read command, 8 dummy cycles (one byte)
+	fmc.reg.Write32(fmc.ctl, io|fmc.ce0CtlFast|uint32(cmd)<<16|0x40|0x1)
+	b := make([]byte, (size+3)&^3)
+	const chunk = 1 << 20
+	for x := int64(0); x < len64(b); x += chunk {
+		end := x + chunk
+		if end > len64(b) {
+			end = len64(b)
+		}
+		readBlock(fmc.mem, off+x, b[x:end])
+	}
+	if fmc.trace != nil {
+		fmc.traceMapped(cmd, off, b[:size])
+	}
+	return b[:size]
 }
-*/
 
-// Reads SPI using ctl user-mode
+func len64(b []byte) int64 { return int64(len(b)) }
+
+// Reads SPI, through the memory-mapped window when possible.
 func (fmc *Fmc) SpiRead(off, size int64) []byte {
+	if !SpiUserRead {
+		if b := fmc.SpiReadMapped(off, size); b != nil {
+			return b
+		}
+	}
+	return fmc.spiReadUser(off, size)
+}
+
+// Reads SPI using ctl user-mode
+func (fmc *Fmc) spiReadUser(off, size int64) []byte {
 	return fmc.spiXferAddr(fmc.read, uint32(off), []byte{0}, size)
 }
 
@@ -124,7 +199,10 @@ func (fmc *Fmc) spi4B() {
 	switch {
 	case fmc.Chip.mx3b4b:
 		_ = fmc.spiXfer([]byte{0xB7}, 0)
-	case fmc.id == 0x010220:
+	case fmc.Chip.enter4B&0x02 != 0:
+		fmc.writeEnable()
+		_ = fmc.spiXfer([]byte{0xB7}, 0)
+	case fmc.id == 0x010220 || fmc.Chip.enter4B&0x08 != 0:
 		_ = fmc.spiXfer([]byte{0x17, 0x80}, 0)
 	default:
 		log.Fatalf("don't know how to set spimode=4B on %#x\n", fmc.id)
@@ -134,7 +212,10 @@ func (fmc *Fmc) spi3B() {
 	switch {
 	case fmc.Chip.mx3b4b:
 		_ = fmc.spiXfer([]byte{0xE9}, 0)
-	case fmc.id == 0x010220:
+	case fmc.Chip.exit4B&0x02 != 0:
+		fmc.writeEnable()
+		_ = fmc.spiXfer([]byte{0xE9}, 0)
+	case fmc.id == 0x010220 || fmc.Chip.exit4B&0x08 != 0:
 		_ = fmc.spiXfer([]byte{0x17, 0x00}, 0)
 	default:
 		log.Fatalf("don't know how to set spimode=3B on %#x\n", fmc.id)
@@ -167,16 +248,88 @@ func (f *Fmc) writeDisable() {
 	_ = f.spiXfer([]byte{0x4}, 0)
 }
 
-func (f *Fmc) EraseBlock(off int64) {
+// Erase types usable with the current address mode, smallest first.
+func (f *Fmc) eraseTypes() []spiErase {
+	var l []spiErase
+	for _, e := range f.Chip.erases {
+		op := e.op
+		if f.Chip.op4b && (e.op4b != 0 || !f.addr4B) {
+			op = e.op4b
+		}
+		if op != 0 {
+			l = append(l, spiErase{Size: e.Size, op: op})
+		}
+	}
+	if len(l) == 0 {
+		l = []spiErase{{Size: f.Chip.EraseSize, op: f.erase}}
+	}
+	return l
+}
+
+// Smallest erase size of the chip.
+func (f *Fmc) MinEraseSize() int64 {
+	return f.eraseTypes()[0].Size
+}
+
+func (f *Fmc) eraseOp(off int64, op byte) {
+	f.checkProt(off, 1)
 	f.writeEnable()
-	_ = f.spiXferAddr(f.erase, uint32(off), nil, 0)
+	_ = f.spiXferAddr(op, uint32(off), nil, 0)
 	status := f.spiWait()
 	if status != 0 {
-		log.Fatalf("While erasing sector 0x%x:  status = 0x%02x", off, status)
+		log.Fatalf("While erasing sector 0x%x (op 0x%02x):  status = 0x%02x", off, op, status)
+	}
+}
+
+func (f *Fmc) EraseBlock(off int64) {
+	f.eraseOp(off, f.erase)
+}
+
+// Erase a range aligned on the smallest erase size, with the largest erases that fit.
+func (f *Fmc) Erase(off, size int64) {
+	types := f.eraseTypes()
+	if min := types[0].Size; off&(min-1) != 0 || size&(min-1) != 0 {
+		log.Fatalf("Erase 0x%x+0x%x: not aligned on smallest erase size 0x%x\n", off, size, min)
+	}
+	for end := off + size; off < end; {
+		e := types[0]
+		for _, x := range types {
+			if off&(x.Size-1) == 0 && off+x.Size <= end {
+				e = x
+			}
+		}
+		f.eraseOp(off, e.op)
+		off += e.Size
+	}
+}
+
+// Write data at any offset: only the smallest erase units that change are erased,
+// partially covered ones are read, merged and rewritten.
+func (f *Fmc) Update(off int64, data []byte) {
+	unit := f.MinEraseSize()
+	start := off &^ (unit - 1)
+	end := (off + len64(data) + unit - 1) &^ (unit - 1)
+	old := f.SpiRead(start, end-start)
+	buf := append([]byte(nil), old...)
+	copy(buf[off-start:], data)
+	for x := int64(0); x < len64(buf); {
+		if bytes.Equal(old[x:x+unit], buf[x:x+unit]) {
+			x += unit
+			continue
+		}
+		// erase and write a run of changed units
+		run := x + unit
+		for run < len64(buf) && !bytes.Equal(old[run:run+unit], buf[run:run+unit]) {
+			run += unit
+		}
+		f.Erase(start+x, run-x)
+		f.Write(start+x, buf[x:run])
+		x = run
 	}
 }
 
 func (f *Fmc) Write(off64 int64, buf []byte) {
+	f.checkProt(off64, len64(buf))
 	off := int(off64)
 	for len(buf) > 0 {
 		chunk := 256 - (off & 0xff)
@@ -194,75 +347,157 @@ func (f *Fmc) Write(off64 int64, buf []byte) {
 	}
 }
 
+// Known chips, takes precedence over SFDP.
 var spiDb = map[uint32]spiChip{
-	0xc22019: {"mx25l25635f", 32 * 1024 * 1024, 64 * 1024, true, true},
-	0xef4019: {"w25q256", 32 * 1024 * 1024, 64 * 1024, true, false},
-	0x20ba20: {"n25q512a", 64 * 1024 * 1024, 64 * 1024, true, true},
-	0xc2201a: {"mx66l51235l", 64 * 1024 * 1024, 64 * 1024, true, true},
-	0x010220: {"s25fl512s", 64 * 1024 * 1024, 256 * 1024, true, false},
+	0xc22019: {name: "mx25l25635f", Size: 32 * 1024 * 1024, EraseSize: 64 * 1024, op4b: true, mx3b4b: true, erases: mxErases},
+	0xef4019: {name: "w25q256", Size: 32 * 1024 * 1024, EraseSize: 64 * 1024, op4b: true, erases: stdErases},
+	0x20ba20: {name: "n25q512a", Size: 64 * 1024 * 1024, EraseSize: 64 * 1024, op4b: true, mx3b4b: true, erases: stdErases},
+	0xc2201a: {name: "mx66l51235l", Size: 64 * 1024 * 1024, EraseSize: 64 * 1024, op4b: true, mx3b4b: true, erases: mxErases},
+	// 4KB erase only applies to the parameter sectors
+	0x010220: {name: "s25fl512s", Size: 64 * 1024 * 1024, EraseSize: 256 * 1024, op4b: true, erases: []spiErase{{256 * 1024, ERASE, ERASE4B}}},
 }
 
-func (f *Fmc) is4B() bool {
-	switch {
-	case f.id == 0x20ba20:
+var stdErases = []spiErase{{4 * 1024, 0x20, 0x21}, {64 * 1024, ERASE, ERASE4B}}
+var mxErases = []spiErase{{4 * 1024, 0x20, 0x21}, {32 * 1024, 0x52, 0x5c}, {64 * 1024, ERASE, ERASE4B}}
+
+// Returns whether the chip is in 4B-address mode, and if the chip is known enough to tell.
+func (f *Fmc) is4B() (bool, bool) {
+	switch f.id >> 16 {
+	case 0x20: // micron
 		buf := f.spiXfer([]byte{RFSR}, 4)
-		return buf[0]&0x01 != 0
-	case f.id == 0x010220:
+		return buf[0]&0x01 != 0, true
+	case 0x01: // spansion
 		buf := f.spiXfer([]byte{BRRD}, 4)
-		return buf[0]&0x80 != 0
-	case f.id == 0xef4019:
+		return buf[0]&0x80 != 0, true
+	case 0xef: // winbond
 		buf := f.spiXfer([]byte{RDCR}, 4)
-		return buf[0]&0x1 != 0
-	case f.Chip.mx3b4b:
+		return buf[0]&0x1 != 0, true
+	case 0xc2: // macronix
 		buf := f.spiXfer([]byte{RDCR}, 4)
-		return buf[0]&0x20 != 0
+		return buf[0]&0x20 != 0, true
 	default:
-		log.Fatalf("is4B: Unknown chip id: %#x\n", f.id)
-		return false
+		return false, false
 	}
 }
 
+// Identify chip from SFDP, with spiDb entries as overrides.
+func (f *Fmc) identify() {
+	chip, err := f.sfdpChip()
+	if over, ok := spiDb[f.id]; ok {
+		if err != nil {
+			chip = spiChip{}
+		}
+		chip.name, chip.Size, chip.op4b, chip.mx3b4b = over.name, over.Size, over.op4b, over.mx3b4b
+		chip.EraseSize, chip.eraseOp, chip.eraseOp4b = over.EraseSize, ERASE, ERASE4B
+		chip.erases = over.erases
+	} else if err != nil {
+		log.Fatalf("SpiId:0x%06x unknown!! (%s)\n", f.id, err)
+	}
+	f.Chip = chip
+}
+
+// Number of chip selects of the BMC flash controller.
+func (a *AstHandle) FmcNumCs() int {
+	if a.Family == 24 {
+		return 5
+	}
+	return 3
+}
+
+// Decode a FMC/SPI segment address register into window offsets from the controller
+// memory base memAddr (FMC_MEM, SPI1_MEM...).
+func (a *AstHandle) fmcSegment(seg uint32, memAddr int64) (start, end int64) {
+	if a.Family >= 26 {
+		// 1MB units, [27:20] of start in bits 11:4, of end in bits 27:20
+		start = int64((seg << 16) & 0x0ff00000)
+		if seg&0x0ff00000 != 0 {
+			end = int64(seg&0x0ff00000) + 0x100000
+		}
+	} else {
+		// 8MB units, absolute AHB addresses
+		start = int64((seg>>16)&0xff)<<23 - memAddr
+		end = int64((seg>>24)&0xff)<<23 - memAddr
+	}
+	return
+}
+
 func (a *AstHandle) FmcNew() *Fmc {
+	return a.FmcNewCs(SpiCs)
+}
+
+// Access the BMC flash on chip select cs (1 is the secondary/golden flash on dual-image boards).
+func (a *AstHandle) FmcNewCs(cs int) *Fmc {
+	if cs < 0 || cs >= a.FmcNumCs() {
+		log.Fatalf("Invalid FMC chip select %d (AST%d00 has %d)\n", cs, a.Family, a.FmcNumCs())
+	}
 	_ = a.AstStop()
+	return a.spiNew("fmc", FMC_ADDR, FMC_MEM, cs)
+}
+
+// Setup a FMC-like spi controller (FMC, SPI1, SPI2) for chip select cs, and identify the chip.
+func (a *AstHandle) spiNew(name string, regAddr, memAddr int64, cs int) *Fmc {
+	reg := Map(name, regAddr, true, 4096)
+	start, end := a.fmcSegment(reg.Read32(FMC_CE0SEG+int64(4*cs)), memAddr)
+	if end <= start || start < 0 {
+		log.Fatalf("%s/CE%d: no address window (seg=0x%08x)\n", name, cs, reg.Read32(FMC_CE0SEG+int64(4*cs)))
+	}
+	fmc0 := reg.Read32(0)
+	if (fmc0>>uint(2*cs))&3 != 2 {
+		log.Fatalf("%s/CE%d: not configured as SPI (%s[0]=0x%08x)\n", name, cs, name, fmc0)
+	}
+	if fmc0&(1<<uint(16+cs)) == 0 {
+		reg.Write32(0, fmc0|1<<uint(16+cs)) // enable writes
+	}
 	fmc := &Fmc{
-		reg:        Map("fmc", FMC_ADDR, true, 4096),
-		mem:        Map("fmc-mem", FMC_MEM, true, 64*1024*1024).(*AstMem),
+		reg:        reg,
+		mem:        Map(fmt.Sprintf("%s-ce%d", name, cs), memAddr+start, true, end-start),
+		memSize:    end - start,
+		cs:         cs,
+		ctl:        FMC_CE0CTL + int64(4*cs),
 		ce0CtlSlow: 0x300,
 		ce0CtlFast: 0x600,
+		trace:      newSpiTrace(name, cs),
+		maxIO:      spiMaxIO(a.Family),
 	}
 	fmc.id = fmc.spiId()
-	if chip, ok := spiDb[fmc.id]; !ok {
-		log.Fatalf("SpiId:0x%06x unknown!!\n", fmc.id)
-	} else {
-		fmc.Chip = chip
+	fmc.identify()
+	stat := fmc.spiStatus()
+	if stat&srWIP != 0 {
+		log.Fatalf("SpiStatus:0x%02x busy (spiid==0x%06x)\n", stat, fmc.id)
 	}
-	stat := fmc.spiStatus() &^ 0x40
-	if stat&^2 != 0 {
-		log.Fatalf("SpiStatus:0x%02x (spiid==0x%06x)\n", stat, fmc.id)
+	if fmc.id>>16 == 0x01 && stat&0x60 != 0 {
+		_ = fmc.spiXfer([]byte{CLSR}, 0) // spansion E_ERR/P_ERR from a previous failure
 	}
-	if stat&2 != 0 {
+	if stat&srWEL != 0 {
 		fmc.writeDisable()
 	}
+	fmc.prot = fmc.Protection()
+	if fmc.prot.Size != 0 {
+		log.Printf("%s/CE%d: flash is write-protected: %s\n", name, cs, fmc.prot)
+	}
 	if SpiMode != 0 {
 		switch SpiMode {
 		case 4:
 			fmc.spi4B()
-			fmc.reg.Write32(0x04, 0x701)
+			fmc.reg.Write32(0x04, fmc.reg.Read32(0x04)|0x700|1<<uint(cs))
 		case 3:
 			fmc.spi3B()
-			fmc.reg.Write32(0x04, 0x700)
+			fmc.reg.Write32(0x04, (fmc.reg.Read32(0x04)|0x700)&^(1<<uint(cs)))
 		default:
 			log.Fatalf("Unknown spiMode:%d\n", SpiMode)
 		}
 	}
-	astIs4B := (fmc.reg.Read32(0x04) & 1) != 0
-	if astIs4B != fmc.is4B() {
-		log.Fatalf("astIs4B(%v) != fmc.is4B(%v)\n", astIs4B, fmc.is4B())
+	astIs4B := (fmc.reg.Read32(0x04)>>uint(cs))&1 != 0
+	fmc.addr4B = astIs4B
+	if chipIs4B, known := fmc.is4B(); !known {
+		log.Printf("Cannot read address mode of chip 0x%06x, assuming FMC setting (4B=%v)\n", fmc.id, astIs4B)
+	} else if astIs4B != chipIs4B {
+		log.Fatalf("astIs4B(%v) != fmc.is4B(%v)\n", astIs4B, chipIs4B)
 	}
 	if fmc.Chip.op4b {
-		fmc.read, fmc.program, fmc.erase = FREAD4B, PPROGRAM4B, ERASE4B
+		fmc.read, fmc.program, fmc.erase = FREAD4B, PPROGRAM4B, fmc.Chip.eraseOp4b
 	} else {
-		fmc.read, fmc.program, fmc.erase = FREAD, PPROGRAM, ERASE
+		fmc.read, fmc.program, fmc.erase = FREAD, PPROGRAM, fmc.Chip.eraseOp
 	}
 	return fmc
 }
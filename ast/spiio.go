@@ -0,0 +1,142 @@
+package ast
+
+import (
+	"fmt"
+	"log"
+)
+
+// Number of data lines for memory-mapped reads: 1, 2 (1-1-2 fast read) or 4 (1-1-4).
+var SpiIO = 1
+
+const (
+	FREAD_DUAL   = 0x3b
+	FREAD_DUAL4B = 0x3c
+	FREAD_QUAD   = 0x6b
+	FREAD_QUAD4B = 0x6c
+	WRSR2        = 0x31
+	RDSR3        = 0x3f // QE in bit 7 (SFDP QE method 3)
+	WRSR3        = 0x3e
+	WRENVSR      = 0x50 // write enable for volatile status register
+
+	ctlIODual = 0x2 << 28 // CE control: dual data
+	ctlIOQuad = 0x4 << 28 // CE control: quad data
+)
+
+// Widest data bus of the FMC/SPI controllers: AST2400/2500 only do dual I/O.
+func spiMaxIO(family int) int {
+	if family >= 26 {
+		return 4
+	}
+	return 2
+}
+
+var fread4B = map[byte]byte{FREAD: FREAD4B, FREAD_DUAL: FREAD_DUAL4B, FREAD_QUAD: FREAD_QUAD4B}
+
+// QE bit requirements, as in JESD216 BFPT dword 15 bits 22:20, for chips without SFDP.
+var qeMethods = map[uint32]int{0x20: 0, 0xc2: 2, 0xef: 4, 0x01: 5}
+
+// Read opcode and CE control IO-mode bits for memory-mapped reads.
+func (f *Fmc) readMode() (byte, uint32) {
+	if SpiIO == 1 {
+		return FREAD, 0
+	}
+	if f.qe != SpiIO {
+		if err := f.ioEnable(SpiIO); err != nil {
+			log.Printf("%s, falling back to single I/O\n", err)
+			SpiIO = 1
+			return FREAD, 0
+		}
+		f.qe = SpiIO
+	}
+	if SpiIO == 4 {
+		return FREAD_QUAD, ctlIOQuad
+	}
+	return FREAD_DUAL, ctlIODual
+}
+
+// Check controller and chip support of dual/quad output fast-read, and set the QE bit for
+// quad: in the volatile status register when the chip has one, otherwise the non-volatile
+// bit is cleared again by Close.
+func (f *Fmc) ioEnable(io int) error {
+	sfdp := f.Chip.sfdp
+	if io > f.maxIO {
+		return fmt.Errorf("spi controller: no %d-line I/O (max %d)", io, f.maxIO)
+	}
+	switch io {
+	case 2:
+		if len(sfdp) > 0 && sfdp[0]&(1<<16) == 0 {
+			return fmt.Errorf("spi 0x%06x: no 1-1-2 fast read", f.id)
+		}
+		return nil
+	case 4:
+		if len(sfdp) > 0 && sfdp[0]&(1<<22) == 0 {
+			return fmt.Errorf("spi 0x%06x: no 1-1-4 fast read", f.id)
+		}
+	default:
+		return fmt.Errorf("-spiio %d: only 1, 2 or 4 data lines", io)
+	}
+	method, ok := qeMethods[f.id>>16]
+	if len(sfdp) >= 15 {
+		method, ok = int(sfdp[14]>>20)&7, true
+	}
+	if !ok {
+		return fmt.Errorf("spi 0x%06x: unknown quad-enable method", f.id)
+	}
+	var set func(on bool)
+	var isSet func() bool
+	bit := func(v, mask uint8, on bool) uint8 {
+		if on {
+			return v | mask
+		}
+		return v &^ mask
+	}
+	switch method {
+	case 0:
+		return nil
+	case 2: // SR1 bit 6
+		isSet = func() bool { return f.spiStatus()&0x40 != 0 }
+		set = func(on bool) { f.spiXfer([]byte{WRSR, bit(f.spiStatus()&^(srWIP|srWEL), 0x40, on)}, 0) }
+	case 1, 4, 5: // SR2 bit 1, written with SR1 by 2-byte WRSR
+		isSet = func() bool { return f.readReg(RDSR2)&0x02 != 0 }
+		set = func(on bool) {
+			f.spiXfer([]byte{WRSR, f.spiStatus() &^ (srWIP | srWEL), bit(f.readReg(RDSR2), 0x02, on)}, 0)
+		}
+	case 6: // SR2 bit 1, own write opcode
+		isSet = func() bool { return f.readReg(RDSR2)&0x02 != 0 }
+		set = func(on bool) { f.spiXfer([]byte{WRSR2, bit(f.readReg(RDSR2), 0x02, on)}, 0) }
+	case 3: // SR3 bit 7
+		isSet = func() bool { return f.readReg(RDSR3)&0x80 != 0 }
+		set = func(on bool) { f.spiXfer([]byte{WRSR3, bit(f.readReg(RDSR3), 0x80, on)}, 0) }
+	default:
+		return fmt.Errorf("spi 0x%06x: unsupported quad-enable method %d", f.id, method)
+	}
+	if isSet() {
+		return nil
+	}
+	// BFPT dword 1: bit 3 volatile status register, bit 4 clear: enabled by opcode 0x50
+	volatile := len(sfdp) > 0 && sfdp[0]&(1<<3) != 0 && sfdp[0]&(1<<4) == 0 || len(sfdp) == 0 && f.id>>16 == 0xef
+	write := func(on bool) {
+		if volatile {
+			_ = f.spiXfer([]byte{WRENVSR}, 0)
+		} else {
+			f.writeEnable()
+		}
+		set(on)
+		f.spiWait()
+	}
+	write(true)
+	if !isSet() {
+		f.writeDisable()
+		return fmt.Errorf("spi 0x%06x: cannot set QE bit (method %d)", f.id, method)
+	}
+	if !volatile {
+		f.qeRestore = func() {
+			write(false)
+			f.qe = 1
+		}
+	}
+	if Verbose {
+		log.Printf("spi 0x%06x: QE bit set, WP#/HOLD# pins are now IO2/IO3\n", f.id)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package ast
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/lprylli/hwmisc/pmem"
+)
+
+// Block protection: BP/TB bits of the status/configuration registers, per vendor.
+const (
+	WRSR  = 0x01
+	RDSR2 = 0x35 // winbond SR2, spansion CR1
+	CLSR  = 0x30 // spansion: clear E_ERR/P_ERR
+
+	srWIP  = 0x01
+	srWEL  = 0x02
+	srSRWD = 0x80
+)
+
+type bpLayout struct {
+	bits     []uint8 // SR bits of BP0, BP1...
+	tbReg    byte    // register holding TB, 0 == SR
+	tbBit    uint8
+	cmpReg   byte // register holding CMP (complement protection), 0 == none
+	cmpBit   uint8
+	fraction bool // BP gives a fraction of the chip instead of a number of 64KB blocks
+}
+
+// keyed by manufacturer id
+var bpLayouts = map[uint32]bpLayout{
+	0xc2: {bits: []uint8{2, 3, 4, 5}, tbReg: RDCR, tbBit: 3},               // macronix, TB is OTP
+	0xef: {bits: []uint8{2, 3, 4, 5}, tbBit: 6, cmpReg: RDSR2, cmpBit: 6},  // winbond
+	0x20: {bits: []uint8{2, 3, 4, 6}, tbBit: 5},                            // micron
+	0x01: {bits: []uint8{2, 3, 4}, tbReg: RDSR2, tbBit: 5, fraction: true}, // spansion, TBPROT is OTP
+}
+
+type SpiProt struct {
+	SR, CR    uint8 // status register, and register holding TB when not the SR
+	BP        uint8
+	TB        bool // protection from the bottom
+	CMP       bool // complement of the BP/TB range
+	SRWD      bool // status register locked while WP# is low
+	Off, Size int64
+	Known     bool // BP/TB layout known for this chip
+}
+
+func (p SpiProt) String() string {
+	s := fmt.Sprintf("SR=0x%02x", p.SR)
+	if !p.Known {
+		return s + " (unknown protection bits)"
+	}
+	if p.CR != 0 {
+		s += fmt.Sprintf(" CR=0x%02x", p.CR)
+	}
+	s += fmt.Sprintf(" BP=%d TB=%t CMP=%t SRWD=%t", p.BP, p.TB, p.CMP, p.SRWD)
+	if p.Size == 0 {
+		return s + " protected: none"
+	}
+	return s + fmt.Sprintf(" protected: 0x%x-0x%x", p.Off, p.Off+p.Size)
+}
+
+func (l bpLayout) protRange(chipSize int64, bp uint8, tb, cmp bool) (off, size int64) {
+	max := uint8(1)<<uint(len(l.bits)) - 1
+	switch {
+	case bp == 0:
+	case l.fraction:
+		size = chipSize >> (max - bp)
+	default:
+		size = 64 * 1024 << (bp - 1)
+	}
+	if size > chipSize {
+		size = chipSize
+	}
+	switch {
+	case cmp && tb:
+		off, size = size, chipSize-size
+	case cmp:
+		off, size = 0, chipSize-size
+	case !tb:
+		off = chipSize - size
+	}
+	return off, size
+}
+
+func (f *Fmc) readReg(op byte) uint8 {
+	return f.spiXfer([]byte{op}, 4)[0]
+}
+
+// Current block protection of the chip.
+func (f *Fmc) Protection() SpiProt {
+	p := SpiProt{SR: f.spiStatus()}
+	p.SRWD = p.SR&srSRWD != 0
+	l, ok := bpLayouts[f.id>>16]
+	if !ok {
+		return p
+	}
+	p.Known = true
+	for i, b := range l.bits {
+		if p.SR>>b&1 != 0 {
+			p.BP |= 1 << uint(i)
+		}
+	}
+	tb := p.SR
+	if l.tbReg != 0 {
+		p.CR = f.readReg(l.tbReg)
+		tb = p.CR
+	}
+	p.TB = tb>>l.tbBit&1 != 0
+	if l.cmpReg != 0 {
+		p.CMP = f.readReg(l.cmpReg)>>l.cmpBit&1 != 0
+	}
+	p.Off, p.Size = l.protRange(f.Chip.Size, p.BP, p.TB, p.CMP)
+	return p
+}
+
+// Set BP bits, the TB/CMP settings are kept.
+func (f *Fmc) SetProtection(bp uint8) error {
+	l, ok := bpLayouts[f.id>>16]
+	if !ok {
+		return fmt.Errorf("spi 0x%06x: unknown protection bits", f.id)
+	}
+	sr := f.spiStatus() &^ (srWIP | srWEL)
+	for i, b := range l.bits {
+		sr &^= 1 << b
+		if bp>>uint(i)&1 != 0 {
+			sr |= 1 << b
+		}
+	}
+	f.writeEnable()
+	_ = f.spiXfer([]byte{WRSR, sr}, 0)
+	f.spiWait()
+	got := f.spiStatus()
+	f.prot = f.Protection()
+	if got&^(srWIP|srWEL) != sr {
+		f.writeDisable()
+		if got&srSRWD != 0 {
+			return fmt.Errorf("status register write ignored (0x%02x): SRWD is set, WP# is probably asserted", got)
+		}
+		return fmt.Errorf("status register write ignored (0x%02x, wanted 0x%02x)", got, sr)
+	}
+	return nil
+}
+
+// Protect size bytes (from the top, or from the bottom with TB), 0 removes protection.
+func (f *Fmc) ProtectSize(size int64) error {
+	l, ok := bpLayouts[f.id>>16]
+	if !ok {
+		return fmt.Errorf("spi 0x%06x: unknown protection bits", f.id)
+	}
+	p := f.Protection()
+	for bp := uint8(0); bp < 1<<uint(len(l.bits)); bp++ {
+		if _, s := l.protRange(f.Chip.Size, bp, p.TB, p.CMP); s == size {
+			return f.SetProtection(bp)
+		}
+	}
+	return fmt.Errorf("no BP setting protects 0x%x bytes (TB=%t CMP=%t)", size, p.TB, p.CMP)
+}
+
+// Refuse erase/program of protected blocks, the chip would silently ignore them.
+func (f *Fmc) checkProt(off, size int64) {
+	if f.prot.Size != 0 && off < f.prot.Off+f.prot.Size && off+size > f.prot.Off {
+		log.Fatalf("spi 0x%x-0x%x: write-protected (%s), see -spiprot\n", off, off+size, f.prot)
+	}
+}
+
+// FMC write address filter: fmcA0 enables one bit per range, fmcA4.. hold the range start
+// (bits 15:0) and end (bits 31:16) as address bits 31:16. Writes to enabled ranges are
+// dropped by the controller.
+const fmcFilterRanges = 5
+
+type FilterRange struct {
+	N          int
+	Start, End int64 // End exclusive
+}
+
+func (r FilterRange) String() string {
+	return fmt.Sprintf("range%d: 0x%08x-0x%08x", r.N, r.Start, r.End)
+}
+
+func writeFilter(reg pmem.Region) (l []FilterRange) {
+	en := reg.Read32(0xa0)
+	for n := 0; n < fmcFilterRanges; n++ {
+		if en>>uint(n)&1 == 0 {
+			continue
+		}
+		v := reg.Read32(0xa4 + 4*int64(n))
+		l = append(l, FilterRange{N: n, Start: int64(v&0xffff) << 16, End: int64(v>>16+1) << 16})
+	}
+	return l
+}
+
+// Enabled write filter ranges of the controller.
+func (f *Fmc) WriteFilter() []FilterRange {
+	return writeFilter(f.reg)
+}
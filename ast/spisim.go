@@ -0,0 +1,164 @@
+package ast
+
+import (
+	"fmt"
+)
+
+// Simulated SPI NOR flash, executing the commands used by Fmc. Memory and register
+// contents not written during a replay are learnt from the first traced reads.
+type SimFlash struct {
+	Id      uint32
+	Size    int64
+	SR      uint8
+	Regs    map[byte]uint8 // other readable registers (RDCR, RDSR2...), by read opcode
+	Addr4B  bool
+	Sfdp    map[int64]byte // SFDP space, learnt from the traced reads
+	srKnown bool
+	mem     []byte
+	known   []bool
+}
+
+func NewSimFlash(id uint32, size int64) *SimFlash {
+	return &SimFlash{Id: id, Size: size, Regs: make(map[byte]uint8), Sfdp: make(map[int64]byte), mem: make([]byte, size), known: make([]bool, size)}
+}
+
+func (s *SimFlash) String() string {
+	return fmt.Sprintf("SR=0x%02x 4B=%t", s.SR, s.Addr4B)
+}
+
+// Xfer executes one SPI transaction (CE# low for out then inSize bytes).
+func (s *SimFlash) Xfer(out []byte, inSize int) []byte {
+	return s.xfer(out, inSize, nil)
+}
+
+var simErases = map[byte]int64{0x20: 4 << 10, 0x21: 4 << 10, 0x52: 32 << 10, 0x5c: 32 << 10, ERASE: 64 << 10, ERASE4B: 64 << 10}
+
+// Register read, with the 4B-address mode bit where the vendor reports it.
+func (s *SimFlash) reg(op byte) uint8 {
+	v := s.Regs[op]
+	var bit uint8
+	switch {
+	case op == RDCR && s.Id>>16 == 0xc2:
+		bit = 0x20
+	case op == RDCR && s.Id>>16 == 0xef, op == RFSR && s.Id>>16 == 0x20:
+		bit = 0x01
+	case op == BRRD && s.Id>>16 == 0x01:
+		bit = 0x80
+	}
+	if s.Addr4B {
+		return v | bit
+	}
+	return v &^ bit
+}
+
+func (s *SimFlash) xfer(out []byte, inSize int, expect []byte) []byte {
+	op := out[0]
+	n := 3
+	if s.Addr4B || op4B[op] {
+		n = 4
+	}
+	var addr int64
+	if len(out) > n {
+		for _, c := range out[1 : 1+n] {
+			addr = addr<<8 | int64(c)
+		}
+		addr %= s.Size
+	}
+	in := make([]byte, inSize)
+	fill := func(v uint8) {
+		for i := range in {
+			in[i] = v
+		}
+	}
+	wel := s.SR&srWEL != 0
+	switch {
+	case op == 0x9f:
+		copy(in, []byte{byte(s.Id >> 16), byte(s.Id >> 8), byte(s.Id)})
+	case op == STATUS:
+		if !s.srKnown && len(expect) > 0 {
+			s.SR, s.srKnown = expect[0]&^srWIP, true
+		}
+		fill(s.SR)
+	case op == RDCR || op == RDSR2 || op == RFSR || op == BRRD || op == RDSR3:
+		if _, ok := s.Regs[op]; !ok && len(expect) > 0 {
+			s.Regs[op] = expect[0]
+		}
+		fill(s.reg(op))
+	case op == 0x06 || op == WRENVSR: // volatile and non-volatile registers are not told apart
+		s.SR |= srWEL
+	case op == 0x04:
+		s.SR &^= srWEL
+	case op == 0xb7:
+		s.Addr4B = true
+	case op == 0xe9:
+		s.Addr4B = false
+	case op == 0x17 && len(out) > 1:
+		s.Addr4B = out[1]&0x80 != 0
+	case op == WRSR && wel:
+		s.SR = out[1] &^ (srWIP | srWEL)
+		if len(out) > 2 {
+			s.Regs[RDSR2] = out[2]
+		}
+	case op == WRSR2 && wel:
+		s.Regs[RDSR2] = out[1]
+		s.SR &^= srWEL
+	case op == WRSR3 && wel:
+		s.Regs[RDSR3] = out[1]
+		s.SR &^= srWEL
+	case op == RDSFDP && len(out) >= 4:
+		// always 3 address bytes, then 8 dummy cycles
+		a := int64(out[1])<<16 | int64(out[2])<<8 | int64(out[3])
+		for i := range in {
+			v, ok := s.Sfdp[a+int64(i)]
+			if !ok {
+				v = 0xff
+				if i < len(expect) {
+					v = expect[i]
+				}
+				s.Sfdp[a+int64(i)] = v
+			}
+			in[i] = v
+		}
+	case op == 0x03:
+		return s.read(addr, inSize, expect)
+	case fread4B[op] != 0 || op == FREAD4B || op == FREAD_DUAL4B || op == FREAD_QUAD4B:
+		return s.read(addr, inSize, expect) // dummy byte is part of out
+	case (op == PPROGRAM || op == PPROGRAM4B) && wel:
+		for i, c := range out[1+n:] {
+			a := addr&^0xff | (addr+int64(i))&0xff // wraps within the page
+			s.learn(a, 0xff)
+			s.mem[a] &= c
+		}
+		s.SR &^= srWEL
+	case simErases[op] != 0 && wel:
+		size := simErases[op]
+		for a := addr &^ (size - 1); a < addr&^(size-1)+size; a++ {
+			s.mem[a], s.known[a] = 0xff, true
+		}
+		s.SR &^= srWEL
+	default:
+		fill(0xff)
+	}
+	return in
+}
+
+func (s *SimFlash) learn(a int64, v byte) {
+	if !s.known[a] {
+		s.mem[a], s.known[a] = v, true
+	}
+}
+
+// Read memory, contents never seen before are taken from expect (0xff beyond).
+func (s *SimFlash) read(addr int64, size int, expect []byte) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		a := (addr + int64(i)) % s.Size
+		v := byte(0xff)
+		if i < len(expect) {
+			v = expect[i]
+		}
+		s.learn(a, v)
+		b[i] = s.mem[a]
+	}
+	return b
+}
@@ -0,0 +1,195 @@
+package ast
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File where to log SPI transactions, one per line:
+//
+//	<sec> op=<op> [addr=<addr>] out=<hex> in=<len> data=<hex>[...]
+//	<sec> mapped op=<op> addr=<addr> in=<len> data=<hex>[...]
+//
+// data is truncated to the first spiTraceData bytes ("..." appended).
+var SpiTrace string
+
+const spiTraceData = 64
+
+type spiTrace struct {
+	f     *os.File
+	start time.Time
+}
+
+// Opcodes followed by an address
+var addrOps = map[byte]bool{0x03: true, FREAD: true, FREAD_DUAL: true, FREAD_QUAD: true, PPROGRAM: true,
+	0x20: true, 0x52: true, ERASE: true, RDSFDP: true}
+
+func newSpiTrace(name string, cs int) *spiTrace {
+	if SpiTrace == "" {
+		return nil
+	}
+	// unbuffered and appended: a trace must survive a log.Fatal, and cover several opens
+	f, err := os.OpenFile(SpiTrace, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t := &spiTrace{f: f, start: time.Now()}
+	fmt.Fprintf(f, "# %s/CE%d %s\n", name, cs, t.start.Format(time.RFC3339))
+	return t
+}
+
+func traceData(in []byte) string {
+	if len(in) > spiTraceData {
+		return hex.EncodeToString(in[:spiTraceData]) + "..."
+	}
+	return hex.EncodeToString(in)
+}
+
+func (fmc *Fmc) addrLen(op byte) int {
+	switch {
+	case op == RDSFDP:
+		return 3
+	case fmc.addr4B || op4B[op]:
+		return 4
+	}
+	return 3
+}
+
+func (fmc *Fmc) traceXfer(out, in []byte) {
+	t := fmc.trace
+	s := fmt.Sprintf("%.6f op=%02x", time.Since(t.start).Seconds(), out[0])
+	if n := fmc.addrLen(out[0]); (addrOps[out[0]] || op4B[out[0]]) && len(out) > n {
+		var addr uint32
+		for _, c := range out[1 : 1+n] {
+			addr = addr<<8 | uint32(c)
+		}
+		s += fmt.Sprintf(" addr=%#x", addr)
+	}
+	fmt.Fprintf(t.f, "%s out=%s in=%d data=%s\n", s, hex.EncodeToString(out), len(in), traceData(in))
+}
+
+func (fmc *Fmc) traceMapped(op byte, off int64, in []byte) {
+	t := fmc.trace
+	fmt.Fprintf(t.f, "%.6f mapped op=%02x addr=%#x in=%d data=%s\n",
+		time.Since(t.start).Seconds(), op, off, len(in), traceData(in))
+}
+
+type spiTraceRec struct {
+	line   int
+	mapped bool
+	op     byte
+	addr   int64
+	out    []byte
+	in     int
+	data   []byte
+}
+
+func parseSpiTrace(file string) ([]spiTraceRec, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var recs []spiTraceRec
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for n := 1; s.Scan(); n++ {
+		l := s.Text()
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		r := spiTraceRec{line: n}
+		for _, kv := range strings.Fields(l)[1:] {
+			if kv == "mapped" {
+				r.mapped = true
+				continue
+			}
+			nv := strings.SplitN(kv, "=", 2)
+			if len(nv) != 2 {
+				return nil, fmt.Errorf("%s:%d: bad field \"%s\"", file, n, kv)
+			}
+			var v uint64
+			switch nv[0] {
+			case "op":
+				v, err = strconv.ParseUint(nv[1], 16, 8)
+				r.op = byte(v)
+			case "addr":
+				v, err = strconv.ParseUint(nv[1], 0, 32)
+				r.addr = int64(v)
+			case "in":
+				r.in, err = strconv.Atoi(nv[1])
+			case "out":
+				r.out, err = hex.DecodeString(nv[1])
+			case "data":
+				r.data, err = hex.DecodeString(strings.TrimSuffix(nv[1], "..."))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", file, n, err)
+			}
+		}
+		recs = append(recs, r)
+	}
+	return recs, s.Err()
+}
+
+// Replay a trace against a simulated flash, reporting transactions where the model and
+// the traced chip disagree. The chip id comes from the first RDID in the trace, the
+// size from spiDb when 0. Returns the number of mismatches.
+func SpiReplay(file string, size int64, addr4B bool) (int, error) {
+	recs, err := parseSpiTrace(file)
+	if err != nil {
+		return 0, err
+	}
+	var sim *SimFlash
+	for _, r := range recs {
+		if !r.mapped && r.op == 0x9f && len(r.data) >= 3 {
+			id := uint32(r.data[0])<<16 | uint32(r.data[1])<<8 | uint32(r.data[2])
+			if size == 0 {
+				size = spiDb[id].Size
+			}
+			if size == 0 {
+				return 0, fmt.Errorf("%s: unknown size for chip 0x%06x", file, id)
+			}
+			sim = NewSimFlash(id, size)
+			break
+		}
+	}
+	if sim == nil {
+		return 0, fmt.Errorf("%s: no RDID (9f) in trace", file)
+	}
+	sim.Addr4B = addr4B
+	mismatches := 0
+	for _, r := range recs {
+		var got []byte
+		if r.mapped {
+			got = sim.read(r.addr, r.in, r.data)
+		} else {
+			got = sim.xfer(r.out, r.in, r.data)
+		}
+		if !r.mapped && r.op == STATUS && len(r.data) > 0 {
+			// busy polling depends on timing, and WEL is only cleared at the end
+			mask := uint8(srWIP)
+			if r.data[0]&srWIP != 0 {
+				mask |= srWEL
+			}
+			for i := range got {
+				got[i] &^= mask
+			}
+			for i := range r.data {
+				r.data[i] &^= mask
+			}
+		}
+		if n := len(r.data); len(got) >= n && string(got[:n]) != string(r.data) {
+			mismatches++
+			fmt.Printf("%s:%d: op=%02x addr=%#x: chip returned %s, model %s (model state: %s)\n",
+				file, r.line, r.op, r.addr, traceData(r.data), traceData(got[:n]), sim)
+		}
+	}
+	return mismatches, nil
+}
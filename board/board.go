@@ -0,0 +1,218 @@
+package board
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lprylli/hwmisc/i2cmux"
+)
+
+// Board i2c topology, one entry per line, '#' starts a comment:
+//
+//	bus <n> <name>
+//	mux <path> <type> [<channel>=<name>...]
+//	dev <name> <path>
+//
+// Paths are i2cmux paths, eg: "dev slot3-idt-switch 2/0x70:3/0x72". Mux types of the
+// paths are taken from the mux entries.
+type Board struct {
+	File    string
+	Buses   map[int]string
+	Muxes   []*Mux
+	Devices []*Device
+}
+
+type Mux struct {
+	Path     i2cmux.Path
+	Type     string
+	Channels map[int]string
+}
+
+type Device struct {
+	Name string
+	Path i2cmux.Path
+}
+
+func Load(file string) (*Board, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := &Board{File: file, Buses: make(map[int]string)}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		l := s.Text()
+		if i := strings.Index(l, "#"); i >= 0 {
+			l = l[:i]
+		}
+		w := strings.Fields(l)
+		if len(w) == 0 {
+			continue
+		}
+		if err := b.parse(w); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, n, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return b, b.check()
+}
+
+func (b *Board) parse(w []string) error {
+	switch {
+	case w[0] == "bus" && len(w) == 3:
+		n, err := strconv.Atoi(w[1])
+		if err != nil {
+			return fmt.Errorf("bad bus number \"%s\"", w[1])
+		}
+		b.Buses[n] = w[2]
+	case w[0] == "mux" && len(w) >= 3:
+		p, err := i2cmux.ParsePath(w[1])
+		if err != nil {
+			return err
+		}
+		t := i2cmux.TypeByName(w[2])
+		if t == nil {
+			return fmt.Errorf("unknown mux type \"%s\"", w[2])
+		}
+		m := &Mux{Path: p, Type: t.Name, Channels: make(map[int]string)}
+		for _, cn := range w[3:] {
+			kv := strings.SplitN(cn, "=", 2)
+			c, err := strconv.Atoi(kv[0])
+			if len(kv) != 2 || err != nil || c < 0 || c >= t.Channels {
+				return fmt.Errorf("bad %s channel name \"%s\"", t.Name, cn)
+			}
+			m.Channels[c] = kv[1]
+		}
+		b.Muxes = append(b.Muxes, m)
+	case w[0] == "dev" && len(w) == 3:
+		p, err := i2cmux.ParsePath(w[2])
+		if err != nil {
+			return err
+		}
+		b.Devices = append(b.Devices, &Device{Name: w[1], Path: p})
+	default:
+		return fmt.Errorf("expected bus <n> <name>, mux <path> <type> [<c>=<name>...] or dev <name> <path>")
+	}
+	return nil
+}
+
+// Every mux crossed by a device or mux path must be listed, names must be unique.
+func (b *Board) check() error {
+	for _, m := range b.Muxes {
+		for i := range m.Path.Hops {
+			u := b.mux(m.Path.Mux(i))
+			if u == nil {
+				return fmt.Errorf("%s: mux %s: mux %s not listed", b.File, m.Path, m.Path.Mux(i))
+			}
+			m.Path.Hops[i].Type = u.Type
+		}
+	}
+	names := make(map[string]bool)
+	for _, d := range b.Devices {
+		if names[d.Name] {
+			return fmt.Errorf("%s: device %s listed twice", b.File, d.Name)
+		}
+		names[d.Name] = true
+		for i := range d.Path.Hops {
+			m := b.mux(d.Path.Mux(i))
+			if m == nil {
+				return fmt.Errorf("%s: device %s: mux %s not listed", b.File, d.Name, d.Path.Mux(i))
+			}
+			d.Path.Hops[i].Type = m.Type
+		}
+	}
+	return nil
+}
+
+func (b *Board) mux(p i2cmux.Path) *Mux {
+	for _, m := range b.Muxes {
+		if m.Path.String() == p.String() {
+			return m
+		}
+	}
+	return nil
+}
+
+func (b *Board) Device(name string) *Device {
+	for _, d := range b.Devices {
+		if d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// Path of a device name, with the mux types of the board; other strings are taken as paths.
+func (b *Board) Resolve(dev string) string {
+	d := b.Device(dev)
+	if d == nil {
+		return dev
+	}
+	s := fmt.Sprintf("%d/", d.Path.Bus)
+	for _, h := range d.Path.Hops {
+		s += fmt.Sprintf("0x%02x@%s:%d/", h.Addr, h.Type, h.Channel)
+	}
+	return s + fmt.Sprintf("0x%02x", d.Path.Addr)
+}
+
+// Root buses of the board.
+func (b *Board) RootBuses() []int {
+	seen := make(map[int]bool)
+	for n := range b.Buses {
+		seen[n] = true
+	}
+	for _, m := range b.Muxes {
+		seen[m.Path.Bus] = true
+	}
+	for _, d := range b.Devices {
+		seen[d.Path.Bus] = true
+	}
+	var l []int
+	for n := range seen {
+		l = append(l, n)
+	}
+	sort.Ints(l)
+	return l
+}
+
+// Compare the board with a scan of its root buses (canonical path -> mux type, "" for
+// other devices). Returns the missing or mismatching entries, and found devices the
+// board does not list.
+func (b *Board) Check(found map[string]string) (problems, unlisted []string) {
+	listed := make(map[string]bool)
+	for _, m := range b.Muxes {
+		p := m.Path.String()
+		listed[p] = true
+		t, ok := found[p]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("mux %s (%s): missing", p, m.Type))
+		case t == "":
+			problems = append(problems, fmt.Sprintf("mux %s (%s): not a mux", p, m.Type))
+		case t != m.Type && !(t == "pca9546" && m.Type == "pca9545"):
+			// pca9545 and pca9546 cannot be told apart
+			problems = append(problems, fmt.Sprintf("mux %s: %s found, %s listed", p, t, m.Type))
+		}
+	}
+	for _, d := range b.Devices {
+		p := d.Path.String()
+		listed[p] = true
+		if _, ok := found[p]; !ok {
+			problems = append(problems, fmt.Sprintf("%s (%s): missing", d.Name, p))
+		}
+	}
+	for p := range found {
+		if !listed[p] {
+			unlisted = append(unlisted, p)
+		}
+	}
+	sort.Strings(unlisted)
+	return problems, unlisted
+}
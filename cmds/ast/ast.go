@@ -5,11 +5,11 @@ import (
 	"encoding/binary"
 	"flag"
 	"fmt"
-	"hash/crc32"
 	"io/ioutil"
 	"log"
 	"math"
 	"strings"
+	"time"
 
 	"github.com/lprylli/hwmisc/ast"
 	"github.com/lprylli/hwmisc/pmem"
@@ -19,36 +19,44 @@ func len64(b []byte) int64 { return int64(len(b)) }
 
 func spiMakeEnv(b []byte, env string) {
 	var sector []byte
-	if len(b) == 0x2000000 {
-		sector = b[0x1fc0000:0x1fd0000]
-	} else if len(b) == 0x10000 {
+	if p := spiLayout.find("u-boot-env"); p != nil && spiPart == "" && len64(b) >= p.off+envSize {
+		sector = b[p.off : p.off+envSize]
+	} else if len(b) == 0x2000000 {
+		sector = b[0x1fc0000 : 0x1fc0000+envSize]
+	} else if len64(b) == envSize {
 		sector = b
 	} else {
 		log.Fatalf("Where to put env in image len 0x%x?!!\n", len(b))
 	}
-	l := strings.Split(env, "\n")
 	for _, c := range sector {
 		if c != 0xff {
 			log.Fatalf("Env sector not originally cleared\n")
 		}
 	}
-	sector[4] = 1
-	pos := 5
-	for _, v := range l {
-		for _, c := range []byte(v) {
-			sector[pos] = c
-			pos++
+	e := &ubootEnv{vars: make(map[string]string), hdr: 5, flags: 1}
+	for _, v := range strings.Split(env, "\n") {
+		if i := strings.Index(v, "="); i <= 0 {
+			if v != "" {
+				log.Printf("env: skipping \"%s\" (expected name=value)\n", v)
+			}
+			continue
 		}
-		sector[pos] = 0
-		pos++
+		e.set(v)
 	}
-	sector[pos] = 0
-	pos++
-	crc := crc32.ChecksumIEEE(sector[5:])
-	binary.LittleEndian.PutUint32(sector[0:], crc)
+	_, data := e.encode()
+	copy(sector, data)
+}
+
+// Read flash, reporting throughput.
+func spiReadTimed(fmc *ast.Fmc, off, size int64) []byte {
+	start := time.Now()
+	b := fmc.SpiRead(off, size)
+	d := time.Since(start).Seconds()
+	fmt.Printf("Read 0x%x bytes in %.1fs (%.2f MB/s)\n", size, d, float64(size)/d/1e6)
+	return b
 }
 
-func doSpiWrite(spiWrite string, spiOff int64, spiLen int64, spiEnv string) {
+func doSpiWrite(a *ast.AstHandle, spiWrite string, spiOff int64, spiLen int64, spiEnv string) {
 	buf, err := ioutil.ReadFile(spiWrite)
 	if err != nil {
 		log.Fatal(err)
@@ -61,33 +69,74 @@ func doSpiWrite(spiWrite string, spiOff int64, spiLen int64, spiEnv string) {
 	} else if spiLen <= 0 {
 		spiLen = len64(buf)
 	}
-	a := ast.New()
-	fmc := a.FmcNew()
-	if spiOff&(fmc.Chip.EraseSize-1) != 0 {
-		log.Fatalf("Cannot write non-block aligned data to flash")
+	fmc := openFlash(a)
+	defer fmc.Close()
+	// only a full flash write must match the flash size
+	checkSize := int64(0)
+	if spiOff == 0 && spiPart == "" && spiLen == len64(buf) {
+		checkSize = fmc.Chip.Size
+	}
+	spiOff, spiLen = partRange(fmc.Chip.Size, spiOff, spiLen, true)
+	validateImage(buf, spiWrite, checkSize)
+	if journalFile == "" {
+		journalFile = spiWrite + ".journal"
+	} else if journalFile == "-" {
+		journalFile = ""
 	}
-	for x := int64(0); x < spiLen; x += fmc.Chip.EraseSize {
+	j := journalOpen(buf, spiOff, spiLen)
+	// an interrupted write of the boot block leaves the BMC unbootable
+	bootEnd := fmc.Chip.EraseSize
+	if p := spiLayout.find("u-boot"); p != nil {
+		bootEnd = p.off + p.size
+	}
+	es := fmc.Chip.EraseSize
+	for x := int64(0); x < spiLen; {
 		sec := x + spiOff
-		chunk := int64(fmc.Chip.EraseSize)
+		// up to the next block boundary
+		chunk := es - sec&(es-1)
 		if chunk > spiLen-x {
 			chunk = spiLen - x
 		}
+		next := x + chunk
+		// sectors done in the journal are compared too: flash may have changed since
 		oldData := fmc.SpiRead(x+spiOff, chunk)
-		if bytes.Compare(oldData, buf[x:x+chunk]) == 0 {
-			fmt.Printf("\rSkipping sector 0x%x: no change", sec)
+		if !sectorChanged(sectorState(oldData, buf[x:x+chunk])) {
+			if j.done[sec] {
+				fmt.Printf("\rSkipping sector 0x%x: done in journal", sec)
+			} else {
+				fmt.Printf("\rSkipping sector 0x%x: no change", sec)
+				j.completed(sec)
+			}
+			x = next
 			continue
 		}
-		fmt.Printf("\rErasing sector 0x%07x   (%2d%%)          ", sec, x*100/spiLen)
-		fmc.EraseBlock(sec)
-		fmt.Printf("\rWriting sector 0x%07x   (%2d%%)          ", sec, (x*100+50)/spiLen)
-
-		fmc.Write(sec, buf[x:x+chunk])
+		if j.done[sec] {
+			fmt.Printf("\rSector 0x%x done in journal but different from image, rewriting\n", sec)
+		}
+		if sec < bootEnd && hostSpi == 0 {
+			fmt.Printf("\rWARNING: rewriting boot sector 0x%x, the BMC will not boot if interrupted now\n", sec)
+		}
+		j.erasing(sec)
+		if chunk == es {
+			fmt.Printf("\rErasing sector 0x%07x   (%2d%%)          ", sec, x*100/spiLen)
+			fmc.EraseBlock(sec)
+			fmt.Printf("\rWriting sector 0x%07x   (%2d%%)          ", sec, (x*100+50)/spiLen)
+			fmc.Write(sec, buf[x:x+chunk])
+		} else {
+			// partial block: read-modify-write of the smallest erase units
+			fmt.Printf("\rUpdating 0x%07x-0x%07x (%2d%%)          ", sec, sec+chunk, x*100/spiLen)
+			fmc.Update(sec, buf[x:x+chunk])
+		}
+		j.completed(sec)
+		x = next
 	}
 	fmt.Printf("\nVerifying...\n")
-	reread := fmc.SpiRead(spiOff, spiLen)
+	reread := spiReadTimed(fmc, spiOff, spiLen)
 	if bytes.Compare(reread, buf[0:spiLen]) != 0 {
+		j.discard()
 		log.Fatalf("Reread comparison failed!\n")
 	}
+	j.finish()
 }
 
 const (
@@ -207,29 +256,59 @@ func i2cDec(c []pmem.GpioChange) {
 
 var i2cMonRaw bool
 
+// AST2600 new register mode: line status, interrupt status and master command.
+func i2cDec26(c []pmem.GpioChange) {
+	for _, x := range c {
+		switch x.Addr & 0x7f {
+		case 0x08:
+			line := func(bit uint32) int {
+				if x.New&bit != 0 {
+					return 1
+				}
+				return 0
+			}
+			fmt.Printf("t=%d SCL=%d,SDA=%d,busy=%d\n", x.Delay, line(ast.I2ccSCL), line(ast.I2ccSDA), line(ast.I2ccBusBusy))
+		case 0x14:
+			fmt.Printf("t=%d isr=%#x\n", x.Delay, x.New)
+		case 0x18:
+			fmt.Printf("t=%d cmd=%#x addr=0x%02x\n", x.Delay, x.New&0xffff, (x.New>>24)&0x7f)
+		}
+	}
+}
+
 func doI2cMon(bus int) {
 	a := ast.New()
 	i2c := a.I2c
 	dram := a.Dram()
 	var mons []*pmem.Monitor
 	i2cEnabled := a.I2cEnabledSet()
-	for i := uint32(0); i < 14; i++ {
+	newMode := a.I2cNewMode()
+	if newMode && !i2cMonRaw {
+		log.Printf("i2c controller in new register mode: only raw monitoring\n")
+	}
+	for i := 0; i < a.I2cBuses(); i++ {
 		var ctxt i2cCtxt
 		ctxt.a = a
 		ctxt.dram = dram
-		ctxt.bus = int(i)
-		base := int64(i*0x40 + 0x40)
-		if i >= 7 {
-			base = int64((i-7)*0x40 + 0x300)
-		}
-		if (bus == -1 || uint32(bus) == i) && i2cEnabled&(1<<i) != 0 && i2c.Read32(base+0) != 0 {
+		ctxt.bus = i
+		base := a.I2cBase(i)
+		if (bus == -1 || bus == i) && i2cEnabled&(1<<uint(i)) != 0 && i2c.Read32(base+0) != 0 {
 			m := pmem.Monitor{M: i2c, Off: base}
-			if a.Family >= 25 {
+			switch {
+			case a.Family >= 26:
+				ctxt.poolBase = int64(0xc00 + 0x20*i)
+			case a.Family >= 25:
 				ctxt.poolBase = int64(0x200 + 16*i)
-			} else {
+			default:
 				ctxt.poolBase = int64(0x800 + ((i2c.Read32(base)>>20)&7)*0x100)
 			}
-			if !i2cMonRaw {
+			if newMode {
+				for _, off := range []int64{0x08, 0x14, 0x18} {
+					m2 := m
+					m2.Off += off
+					mons = append(mons, &m2)
+				}
+			} else if !i2cMonRaw {
 				m.Mask = ^uint32(0x00780000)
 				m.Off += 0x14
 				m.Aux = &ctxt
@@ -245,14 +324,83 @@ func doI2cMon(bus int) {
 
 		}
 	}
-	if !i2cMonRaw {
+	switch {
+	case newMode:
+		pmem.MonLoopFun(mons, i2cDec26, nil)
+	case !i2cMonRaw:
 		pmem.MonLoopFun(mons, i2cSmart, i2cExtra)
-	} else {
+	default:
 		pmem.MonLoopFun(mons, i2cDec, nil)
 
 	}
 }
 
+var hostSpi int
+var hostPgood string
+var force bool
+
+// Refuse to take the host BIOS flash away from a running host.
+func checkHostOff(a *ast.AstHandle) {
+	if !a.ThisIsMe {
+		if !force {
+			log.Fatalf("-hostspi from the host itself: the host is running, use -force if it does not use its BIOS flash\n")
+		}
+		return
+	}
+	if hostPgood == "" {
+		if !force {
+			log.Fatalf("-hostspi: cannot check host power state without -hostpgood <gpio>, use -force to skip check\n")
+		}
+		return
+	}
+	pgood, err := a.GpioValue(hostPgood)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pgood != 0 && !force {
+		log.Fatalf("-hostspi: host is powered on (gpio %s == 1)\n", hostPgood)
+	}
+}
+
+// Open BMC flash, or host BIOS flash with -hostspi.
+func openFlash(a *ast.AstHandle) *ast.Fmc {
+	if hostSpi != 0 {
+		checkHostOff(a)
+		return a.HostSpiNew(hostSpi)
+	}
+	return a.FmcNew()
+}
+
+// Show, and with spec change, the flash block protection.
+func doSpiProt(a *ast.AstHandle, spec string) {
+	fmc := openFlash(a)
+	defer fmc.Close()
+	if spec != "" {
+		var size int64
+		switch spec {
+		case "none":
+		case "all":
+			size = fmc.Chip.Size
+		default:
+			var err error
+			if size, err = parseSize(spec); err != nil {
+				log.Fatalf("-spiprotect: bad size \"%s\"\n", spec)
+			}
+		}
+		if err := fmc.ProtectSize(size); err != nil {
+			log.Fatal(err)
+		}
+	}
+	p := fmc.Protection()
+	fmt.Printf("%s\n", p)
+	if p.SRWD {
+		fmt.Printf("SRWD set: status register is read-only while WP# is low\n")
+	}
+	for _, r := range fmc.WriteFilter() {
+		fmt.Printf("controller write filter %s: writes are dropped\n", r)
+	}
+}
+
 func main() {
 	var astReset bool
 	var i2c3Speed, i2c3Disable bool
@@ -261,6 +409,16 @@ func main() {
 	var spiOff, spiLen int64
 	var i2cMon int
 	var mii bool
+	var layoutSpec string
+	var showParts bool
+	var envList bool
+	var spiProt bool
+	var spiDiff string
+	var spiReplay string
+	var simSize int64
+	var sim4B bool
+	var spiProtect string
+	var envFile string
 	flag.BoolVar(&astReset, "reset", false, "Reset AST chip")
 	flag.BoolVar(&ast.NoWrite, "noop", false, "Fake AST writes")
 	flag.BoolVar(&ast.Verbose, "verbose", false, "Output each individual ast writes")
@@ -270,16 +428,54 @@ func main() {
 	flag.BoolVar(&i2c3Disable, "i2c3dis", false, "continuously monitor/disable i2c bus-3")
 	flag.BoolVar(&spiInfo, "spiinfo", false, "display spi info for bmc")
 	flag.IntVar(&ast.SpiMode, "spimode", 0, "force spi chip in 3B or 4B mode")
+	flag.IntVar(&ast.SpiCs, "spics", 0, "BMC flash chip select (1 == secondary/golden flash on dual-image boards)")
+	flag.IntVar(&ast.SpiIO, "spiio", 1, "data lines for flash reads: 1, 2 (dual output) or 4 (quad output)")
+	flag.StringVar(&ast.SpiTrace, "spitrace", "", "append a trace of flash SPI transactions to this file")
+	flag.StringVar(&spiReplay, "spireplay", "", "replay a -spitrace file against a simulated flash (no hardware access)")
+	flag.Int64Var(&simSize, "simsize", 0, "with -spireplay, flash size (default from known chips)")
+	flag.BoolVar(&sim4B, "sim4b", false, "with -spireplay, flash starts in 4B-address mode")
+	flag.BoolVar(&ast.SpiUserRead, "spiuser", false, "read flash in user-mode instead of memory-mapped fast-read")
+	flag.BoolVar(&spiProt, "spiprot", false, "show flash status register and block protection")
+	flag.StringVar(&spiProtect, "spiprotect", "", "set flash block protection: none, all or protected size (from top, or bottom with TB)")
 	flag.StringVar(&spiRead, "spiread", "", "file where to store flash contents")
 	flag.Int64Var(&spiOff, "spioff", 0, "flash offset to read or write")
 	flag.Int64Var(&spiLen, "spilen", -1, "size to read write")
 	flag.StringVar(&spiWrite, "spiwrite", "", "file to write to flash")
+	flag.StringVar(&spiDiff, "spidiff", "", "compare file with flash, show changed sectors (and partitions with -layout)")
+	flag.StringVar(&journalFile, "journal", "", "journal file to resume an interrupted -spiwrite (default <file>.journal, - == none)")
 	flag.StringVar(&spiEnv, "spienv", "", "env vars to write to flash (comma separated)")
 	flag.IntVar(&i2cMon, "i2cmon", -2, "i2c bus to monitor (-1 == all)")
 	flag.BoolVar(&i2cMonRaw, "i2cmonraw", false, "raw gpio mon for i2c")
 	flag.BoolVar(&mii, "mii", false, "info about mii")
+	flag.IntVar(&hostSpi, "hostspi", 0, "with -spiread/-spiwrite: access host BIOS flash through BMC SPI1 or SPI2 controller")
+	flag.StringVar(&hostPgood, "hostpgood", "", "BMC gpio (eg: B6) reporting host power-good, checked before -hostspi")
+	flag.BoolVar(&force, "force", false, "skip safety checks")
+	flag.StringVar(&imgMachine, "machine", "", "with -spiwrite, check image is for this machine (FIT compatible or MANIFEST MachineName)")
+	flag.StringVar(&layoutSpec, "layout", "", "flash layout: openbmc-32, openbmc-64, mtdparts=<mtd-id>:<parts>, fdt:<file> or image (device-tree in -spiwrite file)")
+	flag.StringVar(&spiPart, "part", "", "with -layout, partition to read or write")
+	flag.BoolVar(&showParts, "parts", false, "show partitions of -layout")
+	flag.BoolVar(&envList, "envlist", false, "list u-boot env variables from flash (or -envfile)")
+	flag.Var(&envSetVars, "envset", "name=value: set u-boot env variable in flash (or -envfile), can be repeated")
+	flag.Var(&envUnsetVars, "envunset", "name: remove u-boot env variable in flash (or -envfile), can be repeated")
+	flag.StringVar(&envFile, "envfile", "", "flash image file to use for -envlist/-envset/-envunset")
+	flag.Int64Var(&envSize, "envsize", envSize, "u-boot env size (CONFIG_ENV_SIZE)")
+	flag.BoolVar(&envRedund, "envredund", false, "u-boot env is redundant (two copies), even if only one copy is valid")
 
 	flag.Parse()
+	if layoutSpec != "" {
+		spiLayout = parseLayout(layoutSpec, spiWrite)
+		if showParts {
+			fmt.Print(spiLayout)
+		}
+	}
+	if spiReplay != "" {
+		n, err := ast.SpiReplay(spiReplay, simSize, sim4B)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: %d mismatches with flash model\n", spiReplay, n)
+		return
+	}
 	chip, step := ast.AstInfo()
 	fmt.Printf("AST%s-A%d\n", chip, step)
 
@@ -310,18 +506,33 @@ func main() {
 	if i2cMon != -2 {
 		doI2cMon(i2cMon)
 	}
+	if spiProt || spiProtect != "" {
+		doSpiProt(a, spiProtect)
+	}
 	if spiRead != "" {
-		fmc := a.FmcNew()
+		fmc := openFlash(a)
+		defer fmc.Close()
+		spiOff, spiLen = partRange(fmc.Chip.Size, spiOff, spiLen, false)
 		if spiLen <= 0 {
 			spiLen = fmc.Chip.Size
 		}
-		buf := fmc.SpiRead(spiOff, spiLen)
+		buf := spiReadTimed(fmc, spiOff, spiLen)
 		err := ioutil.WriteFile(spiRead, buf, 0666)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
+	if spiDiff != "" {
+		doSpiDiff(a, spiDiff)
+	}
 	if spiWrite != "" {
-		doSpiWrite(spiWrite, spiOff, spiLen, spiEnv)
+		doSpiWrite(a, spiWrite, spiOff, spiLen, spiEnv)
+	}
+	if envList || len(envSetVars) > 0 || len(envUnsetVars) > 0 {
+		if envFile != "" {
+			doEnvFile(envFile, envList)
+		} else {
+			doEnvFlash(a, envList)
+		}
 	}
 }
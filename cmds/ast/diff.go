@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/lprylli/hwmisc/ast"
+)
+
+// Sector states of -spidiff
+const (
+	secSame      = '.'
+	secBlank     = ' ' // identical and erased
+	secDiff      = 'X'
+	secToBlank   = '+' // flash blank, image has data
+	secFromBlank = '-' // image blank, flash has data
+)
+
+func isBlank(b []byte) bool {
+	for _, c := range b {
+		if c != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// State of a sector (or part of one) between flash contents f and image b, shared by
+// -spidiff and -spiwrite.
+func sectorState(f, b []byte) byte {
+	switch {
+	case bytes.Equal(f, b) && isBlank(b):
+		return secBlank
+	case bytes.Equal(f, b):
+		return secSame
+	case isBlank(f):
+		return secToBlank
+	case isBlank(b):
+		return secFromBlank
+	default:
+		return secDiff
+	}
+}
+
+// True if a -spiwrite has to erase/program a sector in state s.
+func sectorChanged(s byte) bool {
+	return s != secSame && s != secBlank
+}
+
+// State of each erase sector between flash contents and image.
+func sectorMap(flash, img []byte, es int64) []byte {
+	m := make([]byte, (len64(img)+es-1)/es)
+	for i := range m {
+		lo, hi := int64(i)*es, int64(i+1)*es
+		if hi > len64(img) {
+			hi = len64(img)
+		}
+		m[i] = sectorState(flash[lo:hi], img[lo:hi])
+	}
+	return m
+}
+
+func shortHash(b []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(b))[:16]
+}
+
+// Compare an image with the flash, and show what a -spiwrite would change.
+func doSpiDiff(a *ast.AstHandle, file string) {
+	img, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmc := openFlash(a)
+	defer fmc.Close()
+	if len64(img) != fmc.Chip.Size {
+		log.Printf("%s: size 0x%x, flash size 0x%x\n", file, len(img), fmc.Chip.Size)
+		if len64(img) > fmc.Chip.Size {
+			img = img[:fmc.Chip.Size]
+		}
+	}
+	flash := spiReadTimed(fmc, 0, len64(img))
+	es := fmc.Chip.EraseSize
+	m := sectorMap(flash, img, es)
+
+	fmt.Printf("sector map (0x%x bytes per sector): '.' same, ' ' same and blank, 'X' different,\n", es)
+	fmt.Printf("  '+' written to blank sector, '-' erased by image\n")
+	const perLine = 64
+	for i := 0; i < len(m); i += perLine {
+		end := i + perLine
+		if end > len(m) {
+			end = len(m)
+		}
+		fmt.Printf("0x%08x |%s|\n", int64(i)*es, m[i:end])
+	}
+	changed := 0
+	for _, s := range m {
+		if sectorChanged(s) {
+			changed++
+		}
+	}
+	fmt.Printf("%d/%d sectors would change\n", changed, len(m))
+
+	if spiLayout == nil {
+		return
+	}
+	spiLayout.resolve(fmc.Chip.Size)
+	fmt.Printf("%-12s %-23s %6s %-16s %-16s\n", "partition", "range", "diff", "image-sha256", "flash-sha256")
+	for _, p := range spiLayout {
+		if p.off >= len64(img) {
+			continue
+		}
+		end := p.off + p.size
+		if end > len64(img) {
+			end = len64(img)
+		}
+		n := 0
+		for _, s := range m[p.off/es : (end+es-1)/es] {
+			if sectorChanged(s) {
+				n++
+			}
+		}
+		fmt.Printf("%-12s 0x%08x-0x%08x %6d %s %s\n", p.name, p.off, end, n, shortHash(img[p.off:end]), shortHash(flash[p.off:end]))
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/lprylli/hwmisc/ast"
+)
+
+// u-boot environment: crc32 (LE) [+ flags byte with redundant env] + "name=value\0"... "\0"
+// A redundant env has two copies of envSize bytes, the active one has the higher flags
+// (modulo 256), updates go to the other copy.
+var envSize int64 = 0x10000
+
+type ubootEnv struct {
+	vars      map[string]string
+	hdr       int // 4, or 5 with flags byte
+	redundant bool
+	flags     byte
+	copy      int   // active copy
+	off       int64 // offset of first copy in flash/image
+}
+
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, " ") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
+
+var envSetVars, envUnsetVars stringList
+var envRedund bool
+
+// Offset of the env in flash or image of given size.
+func envOffset(size int64) int64 {
+	if spiLayout != nil {
+		spiLayout.resolve(size)
+		if p := spiLayout.find("u-boot-env"); p != nil {
+			return p.off
+		}
+	}
+	switch size {
+	case 0x2000000:
+		return 0x1fc0000
+	case envSize, 2 * envSize:
+		return 0
+	}
+	log.Fatalf("Where is the env in flash/image of size 0x%x?, use -layout\n", size)
+	return 0
+}
+
+// Check one env copy, hdr is 4 (single env) or 5 (redundant env with flags byte).
+func envValid(b []byte, hdr int) bool {
+	return binary.LittleEndian.Uint32(b) == crc32.ChecksumIEEE(b[hdr:])
+}
+
+func envDecode(b []byte, off int64) (*ubootEnv, error) {
+	e := &ubootEnv{vars: make(map[string]string), off: off}
+	if len64(b) < envSize {
+		return nil, fmt.Errorf("env at 0x%x: truncated", off)
+	}
+	c0 := b[:envSize]
+	var c1 []byte
+	if len64(b) >= 2*envSize {
+		c1 = b[envSize : 2*envSize]
+	}
+	ok0, ok1 := envValid(c0, 5), c1 != nil && envValid(c1, 5)
+	switch {
+	case ok0 && ok1:
+		// same choice as u-boot env_import_redund()
+		f0, f1 := c0[4], c1[4]
+		e.redundant = true
+		if f0 == 0xff && f1 == 0 || f1 > f0 && !(f1 == 0xff && f0 == 0) {
+			e.copy = 1
+		}
+	case ok1 && envRedund:
+		e.redundant, e.copy = true, 1
+	case ok0:
+		e.redundant = envRedund
+	case envValid(c0, 4) && !envRedund:
+		e.hdr = 4
+	default:
+		return nil, fmt.Errorf("env at 0x%x: bad crc", off)
+	}
+	data := c0
+	if e.copy == 1 {
+		data = c1
+	}
+	if e.hdr == 0 {
+		e.hdr, e.flags = 5, data[4]
+	}
+	for _, kv := range bytes.Split(data[e.hdr:], []byte{0}) {
+		if len(kv) == 0 {
+			break
+		}
+		nv := strings.SplitN(string(kv), "=", 2)
+		if len(nv) != 2 {
+			return nil, fmt.Errorf("env at 0x%x: bad entry \"%s\"", off, kv)
+		}
+		e.vars[nv[0]] = nv[1]
+	}
+	return e, nil
+}
+
+// Encode env into a new copy, returns copy index and its contents.
+func (e *ubootEnv) encode() (int, []byte) {
+	b := bytes.Repeat([]byte{0xff}, int(envSize))
+	if e.hdr == 5 {
+		b[4] = e.flags
+	}
+	pos := e.hdr
+	for _, name := range e.names() {
+		kv := name + "=" + e.vars[name]
+		if pos+len(kv)+2 > len(b) {
+			log.Fatalf("env does not fit in 0x%x bytes\n", envSize)
+		}
+		pos += copy(b[pos:], kv)
+		b[pos] = 0
+		pos++
+	}
+	b[pos] = 0
+	// u-boot computes the crc over the whole env data, including the 0xff padding
+	binary.LittleEndian.PutUint32(b, crc32.ChecksumIEEE(b[e.hdr:]))
+	return e.copy, b
+}
+
+func (e *ubootEnv) names() []string {
+	var names []string
+	for k := range e.vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *ubootEnv) String() string {
+	s := fmt.Sprintf("# env at 0x%x, size 0x%x", e.off, envSize)
+	if e.redundant {
+		s += fmt.Sprintf(", redundant copy %d flags %d", e.copy, e.flags)
+	}
+	s += "\n"
+	for _, name := range e.names() {
+		s += name + "=" + e.vars[name] + "\n"
+	}
+	return s
+}
+
+// Apply -envset/-envunset, returns whether anything changed.
+func (e *ubootEnv) edit() bool {
+	changed := false
+	for _, kv := range envSetVars {
+		if e.set(kv) {
+			changed = true
+		}
+	}
+	for _, name := range envUnsetVars {
+		if _, ok := e.vars[name]; ok {
+			delete(e.vars, name)
+			changed = true
+		}
+	}
+	if changed && e.redundant {
+		e.copy ^= 1
+		e.flags++
+	}
+	return changed
+}
+
+func (e *ubootEnv) set(kv string) bool {
+	nv := strings.SplitN(kv, "=", 2)
+	if len(nv) != 2 || nv[0] == "" {
+		log.Fatalf("env: expected name=value, got \"%s\"\n", kv)
+	}
+	if v, ok := e.vars[nv[0]]; ok && v == nv[1] {
+		return false
+	}
+	e.vars[nv[0]] = nv[1]
+	return true
+}
+
+func (e *ubootEnv) span() int64 {
+	if e.redundant {
+		return 2 * envSize
+	}
+	return envSize
+}
+
+// Env of an image file, edited in place.
+func doEnvFile(file string, list bool) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	off := envOffset(len64(b))
+	e, err := envDecode(b[off:], off)
+	if err != nil {
+		log.Fatalf("%s: %s\n", file, err)
+	}
+	if list {
+		fmt.Print(e)
+	}
+	if !e.edit() {
+		return
+	}
+	c, data := e.encode()
+	copy(b[off+int64(c)*envSize:], data)
+	if err := ioutil.WriteFile(file, b, 0666); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s: env updated\n", file)
+}
+
+// Env of BMC flash: only the env copy being updated is rewritten.
+func doEnvFlash(a *ast.AstHandle, list bool) {
+	fmc := openFlash(a)
+	defer fmc.Close()
+	off := envOffset(fmc.Chip.Size)
+	size := 2 * envSize
+	if off+size > fmc.Chip.Size {
+		size = envSize
+	}
+	e, err := envDecode(fmc.SpiRead(off, size), off)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if list {
+		fmt.Print(e)
+	}
+	if !e.edit() {
+		return
+	}
+	c, data := e.encode()
+	envOff := off + int64(c)*envSize
+	fmc.Update(envOff, data)
+	reread, err := envDecode(fmc.SpiRead(off, e.span()), off)
+	if err != nil || reread.copy != c {
+		log.Fatalf("env at 0x%x: verify failed after update (%v)\n", envOff, err)
+	}
+	fmt.Printf("env copy at 0x%x updated\n", envOff)
+}
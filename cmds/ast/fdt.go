@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Minimal flattened device-tree parser (enough for partitions and FIT images).
+
+const (
+	fdtMagic     = 0xd00dfeed
+	fdtBeginNode = 1
+	fdtEndNode   = 2
+	fdtProp      = 3
+	fdtNop       = 4
+	fdtEnd       = 9
+)
+
+type fdtNode struct {
+	name     string
+	props    map[string][]byte
+	children []*fdtNode
+	parent   *fdtNode
+}
+
+var be = binary.BigEndian
+
+func parseFdt(b []byte) (*fdtNode, error) {
+	if len(b) < 40 || be.Uint32(b) != fdtMagic {
+		return nil, fmt.Errorf("not a device-tree blob")
+	}
+	total := int(be.Uint32(b[4:]))
+	structOff := int(be.Uint32(b[8:]))
+	stringsOff := int(be.Uint32(b[12:]))
+	if total > len(b) || structOff >= total || stringsOff >= total {
+		return nil, fmt.Errorf("truncated device-tree (size 0x%x > 0x%x)", total, len(b))
+	}
+	b = b[:total]
+	var root, cur *fdtNode
+	pos := structOff
+	for {
+		if pos+4 > total {
+			return nil, fmt.Errorf("device-tree: unterminated structure")
+		}
+		tok := be.Uint32(b[pos:])
+		pos += 4
+		switch tok {
+		case fdtBeginNode:
+			end := bytes.IndexByte(b[pos:], 0)
+			if end < 0 {
+				return nil, fmt.Errorf("device-tree: bad node name")
+			}
+			n := &fdtNode{name: string(b[pos : pos+end]), props: make(map[string][]byte), parent: cur}
+			if cur == nil {
+				root = n
+			} else {
+				cur.children = append(cur.children, n)
+			}
+			cur = n
+			pos += (end + 4) &^ 3
+		case fdtEndNode:
+			if cur == nil {
+				return nil, fmt.Errorf("device-tree: unbalanced nodes")
+			}
+			cur = cur.parent
+		case fdtProp:
+			if cur == nil || pos+8 > total {
+				return nil, fmt.Errorf("device-tree: bad property")
+			}
+			l := int(be.Uint32(b[pos:]))
+			nameOff := stringsOff + int(be.Uint32(b[pos+4:]))
+			pos += 8
+			if l < 0 || pos+l > total || nameOff < stringsOff || nameOff >= total {
+				return nil, fmt.Errorf("device-tree: bad property")
+			}
+			name := b[nameOff:]
+			end := bytes.IndexByte(name, 0)
+			if end < 0 {
+				return nil, fmt.Errorf("device-tree: bad property name")
+			}
+			name = name[:end]
+			cur.props[string(name)] = b[pos : pos+l]
+			pos += (l + 3) &^ 3
+		case fdtNop:
+		case fdtEnd:
+			if root == nil {
+				return nil, fmt.Errorf("device-tree: empty")
+			}
+			return root, nil
+		default:
+			return nil, fmt.Errorf("device-tree: bad token 0x%x", tok)
+		}
+	}
+}
+
+func (n *fdtNode) child(name string) *fdtNode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *fdtNode) str(prop string) string {
+	v := n.props[prop]
+	return strings.TrimRight(string(v), "\x00")
+}
+
+func (n *fdtNode) compatible(c string) bool {
+	for _, s := range strings.Split(n.str("compatible"), "\x00") {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *fdtNode) cells(prop string, def int) int {
+	if v, ok := n.props[prop]; ok && len(v) == 4 {
+		return int(be.Uint32(v))
+	}
+	return def
+}
+
+// Read a number of 1 or 2 cells.
+func fdtNum(b []byte, cells int) int64 {
+	var v int64
+	for i := 0; i < cells && len(b) >= 4*(i+1); i++ {
+		v = v<<32 | int64(be.Uint32(b[4*i:]))
+	}
+	return v
+}
+
+func (n *fdtNode) walk(fn func(*fdtNode) bool) bool {
+	if fn(n) {
+		return true
+	}
+	for _, c := range n.children {
+		if c.walk(fn) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// Sanity checks of an image before flashing it.
+
+const (
+	uImageMagic  = 0x27051956
+	uImageHdrLen = 64
+)
+
+var uImageTypes = map[byte]string{1: "standalone", 2: "kernel", 3: "ramdisk", 4: "multi", 5: "firmware", 6: "script", 7: "filesystem", 8: "flat_dt"}
+
+var imgMachine string
+
+type imgReport struct {
+	info    []string
+	errs    []string
+	headers int // uImage and FIT headers found
+}
+
+func (r *imgReport) infof(off int, format string, a ...interface{}) {
+	r.info = append(r.info, fmt.Sprintf("0x%08x: ", off)+fmt.Sprintf(format, a...))
+}
+
+func (r *imgReport) errorf(off int, format string, a ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf("0x%08x: ", off)+fmt.Sprintf(format, a...))
+}
+
+// Legacy u-boot image: 64 bytes big-endian header, with header and data crc32.
+func (r *imgReport) uImage(b []byte, off int) {
+	h := b[off:]
+	if len(h) < uImageHdrLen {
+		r.errorf(off, "truncated uImage header")
+		return
+	}
+	hdr := append([]byte(nil), h[:uImageHdrLen]...)
+	hcrc := be.Uint32(hdr[4:])
+	hdr[4], hdr[5], hdr[6], hdr[7] = 0, 0, 0, 0
+	if crc32.ChecksumIEEE(hdr) != hcrc {
+		r.errorf(off, "uImage header crc mismatch")
+		return
+	}
+	size := int(be.Uint32(h[12:]))
+	name := strings.TrimRight(string(h[32:64]), "\x00")
+	if uImageHdrLen+size > len(h) {
+		r.errorf(off, "uImage \"%s\" truncated: data size 0x%x, only 0x%x available", name, size, len(h)-uImageHdrLen)
+		return
+	}
+	if crc32.ChecksumIEEE(h[uImageHdrLen:uImageHdrLen+size]) != be.Uint32(h[24:]) {
+		r.errorf(off, "uImage \"%s\" data crc mismatch", name)
+		return
+	}
+	r.infof(off, "uImage \"%s\" (%s, 0x%x bytes, crc ok)", name, uImageTypes[h[30]], size)
+}
+
+func fitHash(algo string, data []byte) []byte {
+	switch algo {
+	case "crc32":
+		var v [4]byte
+		be.PutUint32(v[:], crc32.ChecksumIEEE(data))
+		return v[:]
+	case "md5":
+		v := md5.Sum(data)
+		return v[:]
+	case "sha1":
+		v := sha1.Sum(data)
+		return v[:]
+	case "sha256":
+		v := sha256.Sum256(data)
+		return v[:]
+	}
+	return nil
+}
+
+// FIT image: device-tree with /images/<img>/data (or external data-offset/data-position)
+// and hash-N subnodes.
+func (r *imgReport) fit(b []byte, off int, root *fdtNode) {
+	images := root.child("images")
+	total := int(be.Uint32(b[off+4:]))
+	var compat []string
+	for _, img := range images.children {
+		data, ok := img.props["data"]
+		if !ok {
+			size := int(fdtNum(img.props["data-size"], 1))
+			start := -1
+			if v, ok := img.props["data-offset"]; ok {
+				start = off + (total+3)&^3 + int(fdtNum(v, 1))
+			} else if v, ok := img.props["data-position"]; ok {
+				start = off + int(fdtNum(v, 1))
+			}
+			if start < 0 || start+size > len(b) {
+				r.errorf(off, "FIT image %s: missing or truncated data", img.name)
+				continue
+			}
+			data = b[start : start+size]
+		}
+		nhash := 0
+		for _, h := range img.children {
+			if !strings.HasPrefix(h.name, "hash") {
+				continue
+			}
+			algo := h.str("algo")
+			v := fitHash(algo, data)
+			if v == nil {
+				continue
+			}
+			if !bytes.Equal(v, h.props["value"]) {
+				r.errorf(off, "FIT image %s: %s mismatch", img.name, algo)
+			}
+			nhash++
+		}
+		if img.str("type") == "flat_dt" {
+			if dt, err := parseFdt(data); err == nil {
+				compat = append(compat, strings.Split(dt.str("compatible"), "\x00")...)
+			}
+		}
+		r.infof(off, "FIT image %s \"%s\" (%s, 0x%x bytes, %d hashes checked)", img.name, img.str("description"), img.str("type"), len(data), nhash)
+	}
+	if imgMachine != "" && len(compat) > 0 && !matchMachine(compat) {
+		r.errorf(off, "FIT device-trees are for %v, not %s", compat, imgMachine)
+	}
+}
+
+func matchMachine(names []string) bool {
+	for _, n := range names {
+		if strings.Contains(n, imgMachine) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenBMC update tarball: MANIFEST with purpose/version/MachineName and image-* files.
+func (r *imgReport) tarball(b []byte) {
+	tr := tar.NewReader(bytes.NewReader(b))
+	var files []string
+	manifest := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			r.errorf(0, "tar: %s", err)
+			return
+		}
+		files = append(files, h.Name)
+		if h.Name == "MANIFEST" {
+			m, _ := ioutil.ReadAll(tr)
+			for _, l := range strings.Split(string(m), "\n") {
+				if kv := strings.SplitN(l, "=", 2); len(kv) == 2 {
+					manifest[kv[0]] = kv[1]
+				}
+			}
+		}
+	}
+	r.infof(0, "tarball: %v, MANIFEST %v", files, manifest)
+	if m := manifest["MachineName"]; m != "" && imgMachine != "" && !strings.Contains(m, imgMachine) {
+		r.errorf(0, "MANIFEST MachineName is %s, not %s", m, imgMachine)
+	}
+	r.errorf(0, "update tarball (purpose=%s, version=%s), not a flash image: extract image-bmc or image-* files",
+		manifest["purpose"], manifest["version"])
+}
+
+// Look for u-boot/kernel headers at the start of the image and of each 64KB block.
+func checkImage(b []byte) *imgReport {
+	r := &imgReport{}
+	switch {
+	case len(b) >= 4 && bytes.Equal(b[:4], []byte("\x7fELF")):
+		r.errorf(0, "ELF file, not a flash image (use objcopy -O binary)")
+		return r
+	case len(b) >= 262 && bytes.Equal(b[257:262], []byte("ustar")):
+		r.tarball(b)
+		return r
+	}
+	for off := 0; off < len(b); off += 0x10000 {
+		if len(b)-off < 8 {
+			break
+		}
+		switch be.Uint32(b[off:]) {
+		case uImageMagic:
+			r.headers++
+			r.uImage(b, off)
+		case fdtMagic:
+			if root, err := parseFdt(b[off:]); err != nil {
+				r.errorf(off, "%s", err)
+			} else if root.child("images") != nil {
+				r.headers++
+				r.fit(b, off, root)
+			}
+		}
+	}
+	return r
+}
+
+// Validate image before erasing anything. size is the flash size for a full-flash write, 0
+// otherwise: partition images may be smaller than their partition (larger ones are
+// rejected by partRange).
+func validateImage(buf []byte, name string, size int64) {
+	r := checkImage(buf)
+	if size > 0 && len64(buf) != size {
+		r.errs = append(r.errs, fmt.Sprintf("%s size 0x%x does not match flash size 0x%x", name, len(buf), size))
+	}
+	if r.headers == 0 && len(r.errs) == 0 {
+		// partition images (eg: raw u-boot, rootfs) may legitimately have none
+		if size > 0 {
+			r.errs = append(r.errs, "no recognizable image header (u-boot or kernel)")
+		} else {
+			r.info = append(r.info, "no recognizable image header")
+		}
+	}
+	for _, s := range r.info {
+		fmt.Printf("%s: %s\n", name, s)
+	}
+	if len(r.errs) == 0 {
+		return
+	}
+	for _, s := range r.errs {
+		fmt.Printf("%s: ERROR: %s\n", name, s)
+	}
+	if !force {
+		log.Fatalf("%s: refusing to flash image, use -force to override\n", name)
+	}
+}
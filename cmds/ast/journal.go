@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Journal of a -spiwrite, kept next to the image so an interrupted write can be resumed:
+//
+//	image <sha256> <off> <len>
+//	erase <sector>    sector erased, contents undefined until "done"
+//	done <sector>     sector contents match the image
+type journal struct {
+	file    string
+	f       *os.File
+	done    map[int64]bool
+	pending int64 // sector being erased/programmed when interrupted, -1 == none
+}
+
+var journalFile string
+
+func journalOpen(buf []byte, off, size int64) *journal {
+	file := journalFile
+	if file == "" {
+		return &journal{done: make(map[int64]bool), pending: -1}
+	}
+	header := fmt.Sprintf("image %x 0x%x 0x%x", sha256.Sum256(buf[:size]), off, size)
+	j := &journal{file: file, done: make(map[int64]bool), pending: -1}
+	if f, err := os.Open(file); err == nil {
+		s := bufio.NewScanner(f)
+		same := s.Scan() && s.Text() == header
+		for same && s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) != 2 {
+				break // truncated last line
+			}
+			sec, err := strconv.ParseInt(fields[1], 0, 64)
+			if err != nil {
+				break
+			}
+			switch fields[0] {
+			case "erase":
+				j.pending = sec
+			case "done":
+				j.done[sec] = true
+				if j.pending == sec {
+					j.pending = -1
+				}
+			}
+		}
+		f.Close()
+		if !same {
+			log.Printf("%s: previous write of a different image or range was interrupted, flash contents are mixed, restarting\n", file)
+			j.done = make(map[int64]bool)
+			j.pending = -1
+		} else {
+			fmt.Printf("%s: resuming interrupted write, %d sectors already done\n", file, len(j.done))
+			if j.pending != -1 {
+				fmt.Printf("%s: write was interrupted while erasing/programming sector 0x%x: its contents are undefined\n", file, j.pending)
+			}
+		}
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Printf("%s: %s, writing without journal\n", file, err)
+		return j
+	}
+	j.f = f
+	j.record(header)
+	for sec := range j.done {
+		j.record("done 0x%x", sec)
+	}
+	return j
+}
+
+// Write a journal line, and make sure it hits the disk before touching the flash.
+func (j *journal) record(format string, a ...interface{}) {
+	if j.f == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(j.f, format+"\n", a...); err != nil {
+		log.Fatalf("%s: %s\n", j.file, err)
+	}
+	if err := j.f.Sync(); err != nil {
+		log.Fatalf("%s: %s\n", j.file, err)
+	}
+}
+
+func (j *journal) erasing(sec int64) { j.record("erase 0x%x", sec) }
+
+func (j *journal) completed(sec int64) {
+	j.done[sec] = true
+	j.record("done 0x%x", sec)
+}
+
+// Write verified: the journal is not needed anymore.
+func (j *journal) finish() {
+	j.discard()
+}
+
+// Verify failed: the done marks cannot be trusted, a rerun must start over.
+func (j *journal) discard() {
+	if j.f == nil {
+		return
+	}
+	j.f.Close()
+	j.f = nil
+	if err := os.Remove(j.file); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+)
+
+type partition struct {
+	name      string
+	off, size int64 // size == -1: up to end of flash
+}
+
+type layout []partition
+
+// Static OpenBMC flash layouts
+var staticLayouts = map[string]layout{
+	"openbmc-32": {
+		{"u-boot", 0, 0x60000},
+		{"u-boot-env", 0x60000, 0x20000},
+		{"kernel", 0x80000, 0x440000},
+		{"rofs", 0x4c0000, 0x1740000},
+		{"rwfs", 0x1c00000, 0x400000},
+	},
+	"openbmc-64": {
+		{"u-boot", 0, 0xe0000},
+		{"u-boot-env", 0xe0000, 0x20000},
+		{"kernel", 0x100000, 0x900000},
+		{"rofs", 0xa00000, 0x2000000},
+		{"rwfs", 0x2a00000, 0x1600000},
+	},
+}
+
+var spiLayout layout
+var spiPart string
+
+func (l layout) find(name string) *partition {
+	for i := range l {
+		if l[i].name == name {
+			return &l[i]
+		}
+	}
+	return nil
+}
+
+// Resolve "rest of flash" partition size, and check partitions fit in flash.
+func (l layout) resolve(chipSize int64) {
+	for i := range l {
+		p := &l[i]
+		if p.size == -1 {
+			p.size = chipSize - p.off
+		}
+		if p.off+p.size > chipSize {
+			log.Fatalf("partition %s (0x%x+0x%x) beyond end of flash (0x%x)\n", p.name, p.off, p.size, chipSize)
+		}
+	}
+}
+
+func (l layout) String() string {
+	var s string
+	for _, p := range l {
+		s += fmt.Sprintf("%-12s 0x%08x-0x%08x (0x%x)\n", p.name, p.off, p.off+p.size, p.size)
+	}
+	return s
+}
+
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k") || strings.HasSuffix(s, "K"):
+		mult = 1024
+	case strings.HasSuffix(s, "m") || strings.HasSuffix(s, "M"):
+		mult = 1024 * 1024
+	case strings.HasSuffix(s, "g") || strings.HasSuffix(s, "G"):
+		mult = 1024 * 1024 * 1024
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseInt(s, 0, 64)
+	return v * mult, err
+}
+
+// Parse MTD command line partitions: [mtdparts=][<mtd-id>:]<size>[@<off>](<name>)[ro],...
+func parseMtdParts(s string) (l layout, err error) {
+	s = strings.TrimPrefix(s, "mtdparts=")
+	if i := strings.Index(s, ":"); i >= 0 {
+		s = s[i+1:]
+	}
+	if i := strings.Index(s, ";"); i >= 0 {
+		s = s[:i] // only first mtd device
+	}
+	var off int64
+	for _, def := range strings.Split(s, ",") {
+		open, close := strings.Index(def, "("), strings.Index(def, ")")
+		if open <= 0 || close < open {
+			return nil, fmt.Errorf("mtdparts: cannot parse \"%s\"", def)
+		}
+		p := partition{name: def[open+1 : close]}
+		sizeOff := strings.SplitN(def[:open], "@", 2)
+		if sizeOff[0] == "-" {
+			p.size = -1
+		} else if p.size, err = parseSize(sizeOff[0]); err != nil {
+			return nil, fmt.Errorf("mtdparts: bad size in \"%s\"", def)
+		}
+		if len(sizeOff) == 2 {
+			if off, err = parseSize(sizeOff[1]); err != nil {
+				return nil, fmt.Errorf("mtdparts: bad offset in \"%s\"", def)
+			}
+		}
+		p.off = off
+		off += p.size
+		l = append(l, p)
+	}
+	return l, nil
+}
+
+// Partitions from a fixed-partitions node of a device-tree.
+func fdtLayout(root *fdtNode) (l layout) {
+	root.walk(func(n *fdtNode) bool {
+		if !n.compatible("fixed-partitions") {
+			return false
+		}
+		ac, sc := n.cells("#address-cells", 1), n.cells("#size-cells", 1)
+		for _, c := range n.children {
+			reg := c.props["reg"]
+			if len(reg) < 4*(ac+sc) {
+				continue
+			}
+			name := c.str("label")
+			if name == "" {
+				name = strings.Split(c.name, "@")[0]
+			}
+			l = append(l, partition{name: name, off: fdtNum(reg, ac), size: fdtNum(reg[4*ac:], sc)})
+		}
+		return len(l) > 0
+	})
+	return l
+}
+
+// Search an image for device-trees (also inside FIT images) with a fixed-partitions node.
+func imageLayout(img []byte) layout {
+	magic := []byte{0xd0, 0x0d, 0xfe, 0xed}
+	for pos := 0; pos < len(img); {
+		i := bytes.Index(img[pos:], magic)
+		if i < 0 {
+			break
+		}
+		pos += i
+		if root, err := parseFdt(img[pos:]); err == nil {
+			if l := fdtLayout(root); l != nil {
+				return l
+			}
+			// FIT image: device-trees are stored as data of /images nodes
+			if images := root.child("images"); images != nil {
+				for _, c := range images.children {
+					if sub, err := parseFdt(c.props["data"]); err == nil {
+						if l := fdtLayout(sub); l != nil {
+							return l
+						}
+					}
+				}
+			}
+		}
+		pos += 4
+	}
+	return nil
+}
+
+// -layout: openbmc-32, openbmc-64, mtdparts=..., fdt:<file> or image (the -spiwrite file)
+func parseLayout(spec string, image string) layout {
+	if l, ok := staticLayouts[spec]; ok {
+		return append(layout(nil), l...)
+	}
+	if strings.Contains(spec, "(") {
+		l, err := parseMtdParts(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return l
+	}
+	file := strings.TrimPrefix(spec, "fdt:")
+	if spec == "image" {
+		file = image
+	}
+	if file == "" || file == spec {
+		log.Fatalf("Unknown layout \"%s\"\n", spec)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l := imageLayout(b)
+	if l == nil {
+		log.Fatalf("%s: no device-tree with fixed-partitions\n", file)
+	}
+	return l
+}
+
+// Apply -part to offset/length of a flash access: a write must fit in the partition.
+func partRange(chipSize int64, off, size int64, write bool) (int64, int64) {
+	if spiPart == "" {
+		return off, size
+	}
+	if spiLayout == nil {
+		log.Fatalf("-part needs a -layout\n")
+	}
+	spiLayout.resolve(chipSize)
+	p := spiLayout.find(spiPart)
+	if p == nil {
+		log.Fatalf("No partition \"%s\" in layout:\n%s", spiPart, spiLayout)
+	}
+	if off != 0 {
+		log.Fatalf("-part and -spioff are exclusive\n")
+	}
+	if size <= 0 {
+		size = p.size
+	}
+	if size > p.size {
+		verb := "read"
+		if write {
+			verb = "write"
+		}
+		log.Fatalf("Cannot %s 0x%x bytes into partition %s of size 0x%x\n", verb, size, p.name, p.size)
+	}
+	return p.off, size
+}
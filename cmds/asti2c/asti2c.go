@@ -8,6 +8,9 @@ import (
 	"log"
 
 	"github.com/lprylli/hwmisc/ast"
+	"github.com/lprylli/hwmisc/board"
+	"github.com/lprylli/hwmisc/i2cmux"
+	"github.com/lprylli/hwmisc/smbus"
 	"periph.io/x/periph/conn/i2c"
 )
 
@@ -19,53 +22,50 @@ func BIT(val uint32, bit uint32) uint32 {
 	return (val >> bit) & 1
 }
 
-func idt_eeread(dev i2c.Dev, addr uint32) byte {
-	tx := []byte{0x47, 4, 1, 0, byte(addr % 256), byte(addr / 256)}
-	err := dev.Tx(tx, nil)
+func idt_eeread(dev *smbus.Dev, addr uint32) byte {
+	q := []byte{1, 0, byte(addr % 256), byte(addr / 256)}
+	err := dev.BlockWrite(0x47, q)
 	if err != nil {
 		log.Fatalf("idt_eeread:query-phase:%s\n", err)
 	}
-	var rbuf [8]byte
-	err = dev.Tx([]byte{0x47}, rbuf[:])
+	rbuf, err := dev.BlockRead(0x47)
 	if err != nil {
-		err = dev.Tx([]byte{0x47}, rbuf[:])
+		rbuf, err = dev.BlockRead(0x47)
 	}
 	if err != nil {
 		log.Fatalf("idt_eeread:read-phase:%s\n", err)
 	}
-	if rbuf[0] != 5 || rbuf[1] != tx[2] || rbuf[2] != tx[3] || rbuf[3] != tx[4] || rbuf[4] != tx[5] {
+	if len(rbuf) != 5 || rbuf[0] != q[0] || rbuf[1] != q[1] || rbuf[2] != q[2] || rbuf[3] != q[3] {
 		log.Fatalf("idt_eeread:invalid-recv-data:got: %02x", rbuf)
 	}
-	return rbuf[5]
+	return rbuf[4]
 }
 
-func idt_eewrite(dev i2c.Dev, addr uint32, b byte) {
-	tx := []byte{0x47, 5, 0, 0, byte(addr % 256), byte(addr / 256), b}
-	err := dev.Tx(tx, nil)
+func idt_eewrite(dev *smbus.Dev, addr uint32, b byte) {
+	err := dev.BlockWrite(0x47, []byte{0, 0, byte(addr % 256), byte(addr / 256), b})
 	if err != nil {
 		log.Fatalf("idt_eewrite:%s\n", err)
 	}
 }
 
-func idt_reg(dev i2c.Dev, reg uint32) uint32 {
+func idt_reg(dev *smbus.Dev, reg uint32) uint32 {
 	regI2c := reg / 4
-	tx := []byte{0x43, 3, 0x1f, byte(regI2c % 256), byte(regI2c / 256)}
-	err := dev.Tx(tx, nil)
+	q := []byte{0x1f, byte(regI2c % 256), byte(regI2c / 256)}
+	err := dev.BlockWrite(0x43, q)
 	if err != nil {
-		log.Fatalf("idt_reg:query-phase:%d\n", err)
+		log.Fatalf("idt_reg:query-phase:%s\n", err)
 	}
-	var rbuf [8]byte
-	err = dev.Tx([]byte{0x43}, rbuf[:])
+	rbuf, err := dev.BlockRead(0x43)
 	if err != nil {
-		log.Fatalf("idt_reg:query-phase:%d\n", err)
+		log.Fatalf("idt_reg:query-phase:%s\n", err)
 	}
-	if rbuf[0] != 7 || rbuf[1] != tx[2] || rbuf[2] != tx[3] || rbuf[3] != tx[4] {
+	if len(rbuf) != 7 || rbuf[0] != q[0] || rbuf[1] != q[1] || rbuf[2] != q[2] {
 		log.Fatalf("idt_reg:recv:got: %02x", rbuf)
 	}
-	return binary.LittleEndian.Uint32(rbuf[4:8])
+	return binary.LittleEndian.Uint32(rbuf[3:7])
 }
 
-func idtInfo(dev i2c.Dev) {
+func idtInfo(dev *smbus.Dev) {
 	id := idt_reg(dev, 0)
 	fmt.Printf("IDT id= 0x%08x\n", id)
 	bcvsts := idt_reg(dev, BCVSTS)
@@ -98,7 +98,7 @@ func idtInfo(dev i2c.Dev) {
 
 }
 
-func idtRead(dev i2c.Dev) []byte {
+func idtRead(dev *smbus.Dev) []byte {
 	b := make([]byte, 1024)
 	for i := uint32(0); int(i) < len(b); i++ {
 		b[i] = idt_eeread(dev, i)
@@ -106,7 +106,7 @@ func idtRead(dev i2c.Dev) []byte {
 	return b
 }
 
-func idtWrite(dev i2c.Dev, b []byte) {
+func idtWrite(dev *smbus.Dev, b []byte) {
 	for i, c := range b {
 		idt_eewrite(dev, uint32(i), c)
 	}
@@ -124,33 +124,70 @@ func main() {
 	var eein, eeout string
 	var reg int64
 	var mux70 int
+	var devPath string
+	var boardFile string
+	var check bool
+	var scanBus int
 	flag.BoolVar(&ast.Verbose, "verbose", false, "verbosity")
 	flag.BoolVar(&info, "info", false, "info about IDT chip")
 	flag.Int64Var(&reg, "reg", -1, "read one IDT register")
 	flag.StringVar(&eein, "eein", "", "file to program to IDT ee")
 	flag.StringVar(&eeout, "eeout", "", "file where to store current IDT ee contents")
 	flag.IntVar(&mux70, "mux70", 8, "pca954x(0x70) setting to access desired pcie-slot smbus")
+	flag.StringVar(&devPath, "dev", "", "i2c path or -board device name of the IDT switch, eg: 2/0x70:3/0x72 (default: from -mux70)")
+	flag.StringVar(&boardFile, "board", "", "board i2c topology file (bus, mux and dev lines)")
+	flag.BoolVar(&check, "check", false, "check the -board file against a scan of its buses")
 	flag.BoolVar(&ast.ExtraCheck, "devcheck", true, "enable dev sanity checks")
+	flag.StringVar(&ast.I2cMode, "i2cmode", ast.I2cMode, "i2c transfer mode: byte, pool or dma (ast2400/2500)")
+	flag.Int64Var(&ast.I2cDmaAddr, "i2cdma", 0, "DRAM address of the i2c dma buffer, required by -i2cmode dma (overwritten, must be unused by the BMC firmware)")
+	flag.BoolVar(&ast.I2cSwitchNewMode, "i2cnewmode", false, "switch an ast2600 i2c controller in legacy mode to new register mode (all buses)")
+	flag.IntVar(&ast.I2cRetries, "i2cretries", ast.I2cRetries, "retries of an i2c transaction after a bus error (with bus recovery)")
+	flag.IntVar(&scanBus, "scan", -1, "scan i2c bus for devices (and behind pca954x muxes)")
 
 	flag.Parse()
 	if reg == -1 && eein == "" && eeout == "" {
 		info = true
 	}
 
+	var b *board.Board
+	if boardFile != "" {
+		var err error
+		if b, err = board.Load(boardFile); err != nil {
+			log.Fatal(err)
+		}
+		devPath = b.Resolve(devPath)
+	} else if check {
+		log.Fatal("-check needs a -board file")
+	}
+
 	ast := ast.New()
 	ast.AstStop()
-	dev := ast.I2cDev(2, 0x72)
-	mux := ast.I2cDev(2, 0x70)
-	var b [1]byte
-	Tx(mux, nil, b[:])
-
-	fmt.Printf("mux70 current setting:0x%02x\n", b[0])
-	mux70b := byte(mux70)
-	if b[0] != mux70b {
-		Tx(mux, []byte{mux70b}, nil)
-		Tx(mux, nil, b[:])
-		fmt.Printf("mux70 new setting:0x%02x\n", b[0])
+	tree := i2cmux.NewTree(ast.I2cBus)
+	if scanBus >= 0 {
+		scan(tree.Bus(scanBus), fmt.Sprintf("%d/", scanBus), map[uint16]bool{}, map[string]string{})
+		return
+	}
+	if check {
+		checkBoard(tree, b)
+		return
+	}
+	if devPath == "" {
+		mux, err := i2cmux.New(tree.Bus(2), 0x70, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c := mux.Type.Channel(byte(mux70))
+		if c < 0 {
+			log.Fatalf("-mux70 0x%02x: does not select a single %s channel\n", mux70, mux.Type.Name)
+		}
+		devPath = fmt.Sprintf("2/0x70:%d/0x72", c)
+	}
+	bus, addr, err := tree.Open(devPath)
+	if err != nil {
+		log.Fatal(err)
 	}
+	fmt.Printf("IDT switch at %s\n", devPath)
+	dev := smbus.New(bus, addr)
 	if info {
 		idtInfo(dev)
 	}
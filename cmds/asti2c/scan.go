@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lprylli/hwmisc/board"
+	"github.com/lprylli/hwmisc/i2cmux"
+	"github.com/lprylli/hwmisc/smbus"
+	"periph.io/x/periph/conn/i2c"
+)
+
+// Probe one address, like i2cdetect: read-byte for eeprom-like ranges (a quick write
+// can lock some of them), quick-write elsewhere.
+func probe(bus i2c.Bus, addr uint16) bool {
+	if addr >= 0x30 && addr <= 0x37 || addr >= 0x50 && addr <= 0x5f {
+		return bus.Tx(addr, nil, make([]byte, 1)) == nil
+	}
+	return bus.Tx(addr, nil, nil) == nil
+}
+
+// Best guess of what a device is, from its address and a few harmless reads.
+func identify(bus i2c.Bus, addr uint16) string {
+	d := smbus.New(bus, addr)
+	switch {
+	case addr >= 0x50 && addr <= 0x57:
+		hdr := make([]byte, 8)
+		if bus.Tx(addr, []byte{0}, hdr) == nil {
+			sum := byte(0)
+			for _, c := range hdr {
+				sum += c
+			}
+			if hdr[0] == 1 && sum == 0 {
+				return "eeprom (IPMI FRU)"
+			}
+		}
+		return "eeprom?"
+	case addr >= 0x18 && addr <= 0x1f:
+		if mfr, err := d.ReadWordData(6); err == nil && mfr != 0xffff {
+			id, _ := d.ReadWordData(7)
+			return fmt.Sprintf("jc42 temperature sensor? (mfr 0x%04x dev 0x%04x)", swap16(mfr), swap16(id))
+		}
+	case addr >= 0x48 && addr <= 0x4f:
+		if t, err := d.ReadWordData(0); err == nil && t != 0xffff {
+			return fmt.Sprintf("lm75-like temperature sensor? (%.1fC)", float64(int16(swap16(t)))/256)
+		}
+	}
+	// PMBUS_REVISION: part I/II revision nibbles
+	if rev, err := d.ReadByteData(0x98); err == nil && rev != 0xff && rev&0x0f <= 3 && rev>>4 <= 3 {
+		s := fmt.Sprintf("pmbus rev 0x%02x", rev)
+		if mfr, err := d.BlockRead(0x99); err == nil && len(mfr) > 0 {
+			s += fmt.Sprintf(" mfr \"%s\"", strings.TrimRight(string(mfr), "\x00 "))
+		}
+		if model, err := d.BlockRead(0x9a); err == nil && len(model) > 0 {
+			s += fmt.Sprintf(" model \"%s\"", strings.TrimRight(string(model), "\x00 "))
+		}
+		return s
+	}
+	return ""
+}
+
+func swap16(v uint16) uint16 { return v<<8 | v>>8 }
+
+// Scan a bus, and recursively the channels of the muxes found on it. Devices already
+// seen upstream are visible on every channel and skipped. Found devices are recorded
+// by path (mux type, "" for other devices).
+func scan(bus i2c.Bus, path string, seen map[uint16]bool, found map[string]string) {
+	// Muxes left on a channel by a previous run would show the devices behind it on this bus.
+	for addr := uint16(0x70); addr <= 0x77; addr++ {
+		if seen[addr] || !probe(bus, addr) {
+			continue
+		}
+		if m, err := i2cmux.New(bus, addr, nil); err == nil {
+			m.Disconnect()
+		}
+	}
+	var addrs []uint16
+	for addr := uint16(0x03); addr <= 0x77; addr++ {
+		if !seen[addr] && probe(bus, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sub := make(map[uint16]bool)
+	for a := range seen {
+		sub[a] = true
+	}
+	for _, a := range addrs {
+		sub[a] = true
+	}
+	for _, addr := range addrs {
+		m, err := i2cmux.New(bus, addr, nil)
+		if err != nil {
+			found[fmt.Sprintf("%s0x%02x", path, addr)] = ""
+			fmt.Printf("%s0x%02x %s\n", path, addr, identify(bus, addr))
+			continue
+		}
+		t := m.Type
+		found[fmt.Sprintf("%s0x%02x", path, addr)] = t.Name
+		fmt.Printf("%s0x%02x %s mux, %d channels\n", path, addr, t.Name, t.Channels)
+		for c := 0; c < t.Channels; c++ {
+			ch, _ := m.Channel(c)
+			scan(ch, fmt.Sprintf("%s0x%02x:%d/", path, addr, c), sub, found)
+		}
+		m.Disconnect()
+	}
+}
+
+// Scan the buses of a board, and report differences with its description.
+func checkBoard(tree *i2cmux.Tree, b *board.Board) {
+	// a scan cannot tell a pca9544 at 0x70 from a pca9540, take the listed type
+	for _, m := range b.Muxes {
+		if m.Type != "pca9544" || m.Path.Addr != 0x70 {
+			continue
+		}
+		if bus, addr, err := tree.OpenPath(m.Path); err == nil {
+			i2cmux.New(bus, addr, i2cmux.TypeByName(m.Type))
+		}
+	}
+	found := make(map[string]string)
+	for _, n := range b.RootBuses() {
+		scan(tree.Bus(n), fmt.Sprintf("%d/", n), map[uint16]bool{}, found)
+	}
+	problems, unlisted := b.Check(found)
+	for _, p := range unlisted {
+		fmt.Printf("%s: %s found, not listed\n", b.File, p)
+	}
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", b.File, p)
+	}
+	if len(problems) > 0 {
+		log.Fatalf("%s: %d problems\n", b.File, len(problems))
+	}
+	fmt.Printf("%s: all %d muxes and %d devices found\n", b.File, len(b.Muxes), len(b.Devices))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lprylli/hwmisc/pci"
+	"github.com/lprylli/hwmisc/pmem"
+)
+
+const einjDir = "/sys/kernel/debug/apei/einj"
+
+var aerRegs = []struct {
+	name string
+	off  int
+	desc map[int]string
+}{
+	{"uncsta", pci.PCI_ERR_UNCOR_STATUS, aerUncErrDesc},
+	{"uncmask", pci.PCI_ERR_UNCOR_MASK, aerUncErrDesc},
+	{"uncsev", pci.PCI_ERR_UNCOR_SEVER, aerUncErrDesc},
+	{"corrsta", pci.PCI_ERR_COR_STATUS, aerCorrErrDesc},
+	{"corrmask", pci.PCI_ERR_COR_MASK, aerCorrErrDesc},
+}
+
+// EINJ error types (ACPI spec, table "Error Type Definition")
+var einjTypes = map[string]uint32{
+	"corr": 0x40, "nonfatal": 0x80, "fatal": 0x100,
+}
+
+func aerShow(d *pci.PciDev) {
+	aer := d.Ecap[pci.PCI_ECAP_ID_AER]
+	if aer == 0 {
+		fmt.Printf("%s (%s): no AER\n", d.Path, d.Name)
+		return
+	}
+	fmt.Printf("%s (%s):\n", d.Path, d.Name)
+	for _, r := range aerRegs {
+		val := d.Read32(aer + r.off)
+		fmt.Printf("    %-8s 0x%08x %s\n", r.name, val, bitStatus(uint64(val), r.desc))
+	}
+}
+
+func bitByName(name string, desc map[int]string) uint32 {
+	for i, s := range desc {
+		if s == name {
+			return 1 << uint(i)
+		}
+	}
+	if strings.HasPrefix(name, "bit-") {
+		if i, err := strconv.Atoi(name[4:]); err == nil && i < 32 {
+			return 1 << uint(i)
+		}
+	}
+	log.Fatalf("Unknown AER error name: \"%s\"\n", name)
+	return 0
+}
+
+// Apply a comma separated list of <reg>+<err> or <reg>-<err> to set or clear
+// error bits in AER mask/severity registers, eg: "uncmask+UR,corrmask-advisory-nf".
+func aerSet(d *pci.PciDev, spec string) {
+	aer := d.Ecap[pci.PCI_ECAP_ID_AER]
+	if aer == 0 {
+		log.Fatalf("%s (%s): no AER\n", d.Path, d.Name)
+	}
+	for _, item := range strings.Split(spec, ",") {
+		pos := strings.IndexAny(item, "+-")
+		if pos <= 0 {
+			log.Fatalf("Cannot parse AER setting \"%s\"\n", item)
+		}
+		found := false
+		for _, r := range aerRegs {
+			if r.name != item[:pos] || strings.HasSuffix(r.name, "sta") {
+				continue
+			}
+			found = true
+			bit := bitByName(item[pos+1:], r.desc)
+			val := d.Read32(aer + r.off)
+			if item[pos] == '+' {
+				val |= bit
+			} else {
+				val &^= bit
+			}
+			d.Write32(aer+r.off, val)
+		}
+		if !found {
+			log.Fatalf("Unknown AER register in \"%s\" (use uncmask, uncsev or corrmask)\n", item)
+		}
+	}
+	aerShow(d)
+}
+
+func einjWrite(file string, val string) error {
+	return ioutil.WriteFile(einjDir+"/"+file, []byte(val), 0600)
+}
+
+// Inject a pcie error targeting device d through ACPI EINJ.
+func einjInject(d *pci.PciDev, errType uint32) error {
+	avail, err := ioutil.ReadFile(einjDir + "/available_error_type")
+	if err != nil {
+		return fmt.Errorf("EINJ not available (is debugfs mounted and einj loaded?): %s", err)
+	}
+	if !strings.Contains(string(avail), fmt.Sprintf("0x%08x", errType)) {
+		return fmt.Errorf("EINJ error type 0x%x not supported by firmware (available: %s)", errType, strings.TrimSpace(string(avail)))
+	}
+	sbdf := uint32(d.Domain())<<24 | uint32(d.ReqId())<<8
+	steps := []struct{ file, val string }{
+		{"error_type", fmt.Sprintf("0x%x", errType)},
+		{"flags", "0x4"}, // param4 holds pcie sbdf
+		{"param1", "0"}, {"param2", "0"}, {"param3", "0"},
+		{"param4", fmt.Sprintf("0x%x", sbdf)},
+		{"notrigger", "0"},
+		{"error_inject", "1"},
+	}
+	for _, s := range steps {
+		if err := einjWrite(s.file, s.val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Generate an Unsupported Request by reading the first memory BAR of d while
+// memory decoding is disabled: the read targets an address the device no longer claims.
+func urInject(d *pci.PciDev) error {
+	var addr uint64
+	lastBar := 0x24
+	if d.Read8(pci.PCI_HEADER_TYPE)&0x7f == pci.PCI_HEADER_TYPE_BRIDGE {
+		lastBar = 0x14 // bus numbers and windows beyond
+	}
+	for bar := 0x10; bar <= lastBar && addr == 0; bar += 4 {
+		lo := d.Read32(bar)
+		if lo&1 != 0 {
+			continue // io bar
+		}
+		addr = uint64(lo &^ 0xf)
+		if lo&6 == 4 {
+			bar += 4
+			addr |= uint64(d.Read32(bar)) << 32
+		}
+	}
+	if addr == 0 {
+		return fmt.Errorf("%s: no memory BAR to target", d.Name)
+	}
+	log.Printf("%s: disabling memory decode and reading 0x%x\n", d.Name, addr)
+	cmd := d.Read16(0x4)
+	m := pmem.MapPrivate("ur-target", int64(addr&^0xfff), false, 4096)
+	defer pmem.Unmap(m)
+	d.Write16(0x4, cmd&^0x2)
+	val := m.Read32(int64(addr & 0xfff))
+	d.Write16(0x4, cmd)
+	if val != ^uint32(0) {
+		log.Printf("%s: read returned 0x%08x (expected 0xffffffff for UR)\n", d.Name, val)
+	}
+	return nil
+}
+
+// Inject an error on device path, then poll the device and its upstream port to confirm detection.
+func inject(w *pci.World, path string, kind string) {
+	d := findDev(w, path)
+	var err error
+	if kind == "ur" {
+		err = urInject(d)
+	} else if t, ok := einjTypes[kind]; ok {
+		err = einjInject(d, t)
+	} else {
+		log.Fatalf("-inject: expect corr, nonfatal, fatal or ur, got \"%s\"\n", kind)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	devs := []*pci.PciDev{d}
+	if d.Parent() != nil {
+		devs = append(devs, d.Parent())
+	}
+	var errors int64
+	for _, x := range devs {
+		appDev := newPciDev(x)
+		appDev.uncIgnore, appDev.corrIgnore = 0, 0
+		errors += errPoll(appDev)
+		for i := 0; i < 32; i++ {
+			if appDev.corrErrs[i] > 0 {
+				fmt.Printf("%s: detected corr %s\n", x.Path, bitStatus(1<<uint(i), aerCorrErrDesc))
+			}
+			if appDev.uncErrs[i] > 0 {
+				fmt.Printf("%s: detected unc %s\n", x.Path, bitStatus(1<<uint(i), aerUncErrDesc))
+			}
+		}
+	}
+	if errors == 0 {
+		log.Fatalf("%s: injected %s error was not detected\n", d.Path, kind)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Counts of errors reported by the kernel AER/DPC drivers, which often clear
+// AER status before errPoll gets to see it.
+type kernelErrs struct {
+	corrErrs [32]int64
+	uncErrs  [32]int64
+	dpc      int64
+}
+
+var kmsgLock sync.Mutex
+var kmsgFollow bool
+
+// "<driver> 0000:00:01.1: AER: <msg>" (older kernels don't have the "AER: " prefix on every line)
+var kmsgRe = regexp.MustCompile(`([0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]): (?:(AER|DPC): )?(.*)$`)
+var kmsgStatusRe = regexp.MustCompile(`error status/mask=([0-9a-f]{8})/([0-9a-f]{8})`)
+
+type kmsgParser struct {
+	devs     map[string]*PciDev
+	severity map[string]string // last severity reported per device
+}
+
+func (p *kmsgParser) parse(msg string) {
+	m := kmsgRe.FindStringSubmatch(msg)
+	if m == nil {
+		return
+	}
+	name, kind, text := m[1], m[2], m[3]
+	if kind == "" && !strings.Contains(text, "PCIe Bus Error") && !strings.Contains(text, "error status/mask") {
+		return
+	}
+	d := p.devs[name]
+	if verbose {
+		log.Printf("kmsg: %s", msg)
+	}
+	switch {
+	case kind == "DPC" && strings.HasPrefix(text, "containment event"):
+		if d != nil {
+			kmsgLock.Lock()
+			d.kernel.dpc++
+			kmsgLock.Unlock()
+		}
+	case strings.Contains(text, "severity="):
+		sev := text[strings.Index(text, "severity=")+9:]
+		switch {
+		case strings.HasPrefix(sev, "Correct"):
+			p.severity[name] = "corr"
+		case strings.HasPrefix(sev, "Uncorrect"):
+			p.severity[name] = "unc"
+		default:
+			log.Printf("kmsg: %s: unknown severity in \"%s\"\n", name, text)
+			delete(p.severity, name)
+		}
+	case strings.Contains(text, "error status/mask="):
+		s := kmsgStatusRe.FindStringSubmatch(text)
+		sev := p.severity[name]
+		if s == nil || sev == "" {
+			return
+		}
+		status, _ := strconv.ParseUint(s[1], 16, 32)
+		mask, _ := strconv.ParseUint(s[2], 16, 32)
+		if d == nil {
+			log.Printf("kmsg: %s error on unmonitored device %s (status=0x%x)\n", sev, name, status&^mask)
+			return
+		}
+		errs := &d.kernel.corrErrs
+		if sev == "unc" {
+			errs = &d.kernel.uncErrs
+		}
+		kmsgLock.Lock()
+		for i, bits := 0, status&^mask; bits != 0; i, bits = i+1, bits>>1 {
+			if bits&1 != 0 {
+				errs[i]++
+			}
+		}
+		kmsgLock.Unlock()
+		delete(p.severity, name)
+	}
+}
+
+func (k *kernelErrs) total() (n int64) {
+	for i := 0; i < 32; i++ {
+		n += k.corrErrs[i] + k.uncErrs[i]
+	}
+	return n + k.dpc
+}
+
+// Follow new records from /dev/kmsg, and account kernel AER/DPC reports to monitored devices.
+func kmsgStart(devs []*PciDev) {
+	f, err := os.Open("/dev/kmsg")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		log.Fatal(err)
+	}
+	p := &kmsgParser{devs: make(map[string]*PciDev), severity: make(map[string]string)}
+	for _, d := range devs {
+		p.devs[d.Name] = d
+	}
+	go func() {
+		buf := make([]byte, 8192)
+		for {
+			// each read returns one record: "prio,seq,usec,flags;msg\n[ dict...]"
+			n, err := f.Read(buf)
+			if err != nil {
+				if err == io.EOF || errors.Is(err, syscall.EAGAIN) {
+					time.Sleep(100 * time.Millisecond) // no new record
+					continue
+				}
+				if errors.Is(err, syscall.EPIPE) {
+					continue // records were overwritten before we read them
+				}
+				log.Fatalf("/dev/kmsg: %s\n", err)
+			}
+			rec := string(buf[:n])
+			if i := strings.Index(rec, ";"); i >= 0 {
+				rec = rec[i+1:]
+			}
+			if i := strings.Index(rec, "\n"); i >= 0 {
+				rec = rec[:i]
+			}
+			p.parse(rec)
+		}
+	}()
+}
@@ -11,9 +11,22 @@ import (
 
 type PciDev struct {
 	*pci.PciDev
-	errs     int64
-	corrErrs [32]int64
-	uncErrs  [32]int64
+	errs       int64
+	corrErrs   [32]int64
+	uncErrs    [32]int64
+	uncIgnore  uint32
+	corrIgnore uint32
+	threshold  float64
+	prevErrs   int64
+	kernel     kernelErrs
+}
+
+func newPciDev(d *pci.PciDev) *PciDev {
+	appDev := &PciDev{PciDev: d}
+	p := policyFor(d)
+	appDev.uncIgnore, appDev.corrIgnore, appDev.threshold = p.uncIgnore, p.corrIgnore, p.threshold
+	d.App = appDev
+	return appDev
 }
 
 func (d *PciDev) Child() *PciDev {
@@ -36,17 +49,28 @@ var pciExpErrDesc = map[int]string{
 	0: "corr", 1: "nonFatal", 2: "Fatal", 3: "UR",
 }
 
-var aerUncUrMask uint32 = 1 << 20                // mask UR
-var aerCorrUrMask uint32 = (1 << 13) | (1 << 15) // mask nf-advisory + log-overflow (set by UR evt).
-var devExpErrMask uint16 = 0x9                   // mask UR+corr
+const aerUncUr uint32 = 1 << 20                // UR
+const aerCorrUr uint32 = (1 << 13) | (1 << 15) // nf-advisory + log-overflow (set by UR evt).
+var devExpErrMask uint16 = 0x9                 // mask UR+corr
+var reportUR bool
 var verbose bool
 
+// AER status bits that are not counted as errors for a device.
+func aerIgnore(d *pci.PciDev) (unc, corr uint32) {
+	p := policyFor(d)
+	return p.uncIgnore, p.corrIgnore
+}
+
 func errPoll(d *PciDev) (errors int64) {
+	aer := d.Ecap[pci.PCI_ECAP_ID_AER]
+	if aer == 0 {
+		return 0
+	}
 	// correctable errors
-	err := d.Read32(d.Ecap[pci.PCI_ECAP_ID_AER] + 0x10)
-	err &^= aerCorrUrMask
+	err := d.Read32(aer + pci.PCI_ERR_COR_STATUS)
+	err &^= d.corrIgnore
 	if err != 0 {
-		d.Write32(d.Ecap[pci.PCI_ECAP_ID_AER]+0x10, err)
+		d.Write32(aer+pci.PCI_ERR_COR_STATUS, err)
 		//log.Printf("%s:cerr=#%08x", d.name, err)
 		for i := 0; err != 0; i++ {
 			if err&1 != 0 {
@@ -58,10 +82,10 @@ func errPoll(d *PciDev) (errors int64) {
 		}
 	}
 	// uncorrectable errors
-	err = d.Read32(d.Ecap[pci.PCI_ECAP_ID_AER] + 0x4)
-	err &^= aerUncUrMask
+	err = d.Read32(aer + pci.PCI_ERR_UNCOR_STATUS)
+	err &^= d.uncIgnore
 	if err != 0 {
-		d.Write32(d.Ecap[pci.PCI_ECAP_ID_AER]+0x4, err)
+		d.Write32(aer+pci.PCI_ERR_UNCOR_STATUS, err)
 		//log.Printf("%s:correrr=#%08x", d.name, err)
 		for i := 0; err != 0; i++ {
 			if err&1 != 0 {
@@ -75,22 +99,31 @@ func errPoll(d *PciDev) (errors int64) {
 	return errors
 }
 
-func statsGen(duration time.Duration, errs []int64, errMap map[int]string, errType string) {
+func statsGen(duration time.Duration, errs []int64, kErrs []int64, errMap map[int]string, errType string) {
 	for i := 0; i < 32; i++ {
-		if errs[i] > 0 {
+		if errs[i] > 0 || (kmsgFollow && kErrs[i] > 0) {
 			errDesc := errMap[i]
 			if errDesc == "" {
 				errDesc = fmt.Sprintf("%s-%d", errType, i)
 			}
-			fmt.Printf("    %s, count=%d: rate=%g err/s\n",
-				errDesc, errs[i], float64(errs[i])/float64(duration)*1e9)
+			var kernel string
+			if kmsgFollow {
+				kernel = fmt.Sprintf(" kernel=%d", kErrs[i])
+			}
+			fmt.Printf("    %s, count=%d%s: rate=%g err/s\n",
+				errDesc, errs[i], kernel, float64(errs[i])/float64(duration)*1e9)
 		}
 	}
 }
 func stats(d *PciDev, duration time.Duration) {
+	kmsgLock.Lock()
+	defer kmsgLock.Unlock()
 	fmt.Printf("%s:\n", d.Path)
-	statsGen(duration, d.corrErrs[:], aerCorrErrDesc, "corr")
-	statsGen(duration, d.uncErrs[:], aerUncErrDesc, "unc")
+	statsGen(duration, d.corrErrs[:], d.kernel.corrErrs[:], aerCorrErrDesc, "corr")
+	statsGen(duration, d.uncErrs[:], d.kernel.uncErrs[:], aerUncErrDesc, "unc")
+	if d.kernel.dpc > 0 {
+		fmt.Printf("    DPC containment events (kernel)=%d\n", d.kernel.dpc)
+	}
 	fmt.Printf("\n\n")
 
 }
@@ -102,15 +135,20 @@ func min(a, b int) int {
 	return b
 }
 
-func showLinks(world *pci.World, aer bool) []*PciDev {
+func showLinks(world *pci.World) []*PciDev {
 	var links []*PciDev
 	for _, d := range world.Devs {
-		if d.LnkChild != nil && verbose {
+		if d.LnkChild == nil {
+			continue
+		}
+		if verbose {
 			log.Printf("%s:%d:%d\n", d.Name, d.Ecap[pci.PCI_ECAP_ID_AER], d.LnkChild.Ecap[pci.PCI_ECAP_ID_AER])
 		}
-		// Exception for some AMD GPP root port not advertising AER (1022:1483), and blacklist internal pcie links (1022:1484)
-		upQual := (d.Ecap[pci.PCI_ECAP_ID_AER] > 0 && (d.Vendor != 0x1022 || d.Device != 0x1484)) || (!aer && d.Vendor == 0x1022 && d.Device == 0x1483)
-		if d.LnkChild != nil && upQual && d.LnkChild.Ecap[pci.PCI_ECAP_ID_AER] > 0 {
+		// exceptions for ports not advertising AER or links to ignore come from the policy
+		up, down := policyFor(d), policyFor(d.LnkChild)
+		upQual := !up.blacklist && (d.Ecap[pci.PCI_ECAP_ID_AER] > 0 || up.force)
+		downQual := !down.blacklist && (d.LnkChild.Ecap[pci.PCI_ECAP_ID_AER] > 0 || down.force)
+		if upQual && downQual {
 			d.GetSpeed()
 			c := d.LnkChild
 			c.GetSpeed()
@@ -126,23 +164,28 @@ func showLinks(world *pci.World, aer bool) []*PciDev {
 				other += fmt.Sprintf("downcap=x%d.gen%d", c.LnkCapWidth, c.LnkCapSpeed)
 			}
 			fmt.Printf("%s (%s <-> %s)  (x%d.gen%d) %s\n", c.Path, d.Name, c.Name, d.LnkWidth, d.LnkSpeed, other)
-			appDev := PciDev{PciDev: d}
-			d.App = &appDev
-			d.LnkChild.App = &PciDev{PciDev: d.LnkChild}
-			links = append(links, &appDev)
+			links = append(links, newPciDev(d))
+			newPciDev(d.LnkChild)
 		}
 	}
 	return links
 }
 
 func monLinks(world *pci.World, nbIter int, delayNano time.Duration) {
-	links := showLinks(world, true)
+	links := showLinks(world)
 	var totalErrors int64
 	// The LinksWithErr map records whether any error was detected for a device
 	// in the previous iteration (to decide whether to include it in next high-frequency poll phase)
 
 	var prevLinksWithErr = make(map[*PciDev]bool)
 	log.Printf("Monitoring %d links\n", len(links))
+	if kmsgFollow {
+		var devs []*PciDev
+		for _, d := range links {
+			devs = append(devs, d, d.Child())
+		}
+		kmsgStart(devs)
+	}
 
 	// Each iteration last about one second, and has two phases:
 	//  first we poll every link
@@ -152,6 +195,7 @@ func monLinks(world *pci.World, nbIter int, delayNano time.Duration) {
 		//
 		var errors int64
 		var linksWithErr []*PciDev
+		iterStart := time.Now()
 
 		// go over all links to check for errors
 		for _, d := range links {
@@ -188,18 +232,33 @@ func monLinks(world *pci.World, nbIter int, delayNano time.Duration) {
 		}
 		totalErrors += errors
 		log.Printf("Errors=%d (total=%d)\n", errors, totalErrors)
+		iterDuration := time.Now().Sub(iterStart)
+		for _, d := range links {
+			checkThreshold(d, iterDuration)
+			checkThreshold(d.Child(), iterDuration)
+		}
 	}
 	duration := time.Now().Sub(globalStart)
-	for _, d := range links {
-		if d.errs > 0 {
-			stats(d, duration)
-		}
-		if d.Child().errs > 0 {
-			stats(d.Child(), duration)
+	for _, l := range links {
+		for _, d := range []*PciDev{l, l.Child()} {
+			kmsgLock.Lock()
+			kErrs := d.kernel.total()
+			kmsgLock.Unlock()
+			if d.errs > 0 || kErrs > 0 {
+				stats(d, duration)
+			}
 		}
 	}
 }
 
+func checkThreshold(d *PciDev, duration time.Duration) {
+	rate := float64(d.errs-d.prevErrs) / duration.Seconds()
+	d.prevErrs = d.errs
+	if d.threshold > 0 && rate > d.threshold {
+		log.Printf("ALERT %s: %g err/s above threshold %g err/s\n", d.Path, rate, d.threshold)
+	}
+}
+
 func bitStatus(val uint64, desc map[int]string) string {
 	var res string
 	for i := 0; val != 0; i++ {
@@ -236,16 +295,17 @@ func errBrowse(w *pci.World, clear bool) {
 			}
 		}
 		if d.Ecap[pci.PCI_ECAP_ID_AER] > 0 {
-			aerUncReg := d.Ecap[pci.PCI_ECAP_ID_AER] + 0x4
-			eStat := d.Read32(aerUncReg) &^ aerUncUrMask
+			uncIgnore, corrIgnore := aerIgnore(d)
+			aerUncReg := d.Ecap[pci.PCI_ECAP_ID_AER] + pci.PCI_ERR_UNCOR_STATUS
+			eStat := d.Read32(aerUncReg) &^ uncIgnore
 			if eStat != 0 {
 				report = append(report, fmt.Sprintf("AerUncSta: %s", bitStatus(uint64(eStat), aerUncErrDesc)))
 				if clear {
 					d.Write32(aerUncReg, eStat)
 				}
 			}
-			aerCorrReg := d.Ecap[pci.PCI_ECAP_ID_AER] + 0x10
-			eStat = d.Read32(aerCorrReg) &^ aerCorrUrMask
+			aerCorrReg := d.Ecap[pci.PCI_ECAP_ID_AER] + pci.PCI_ERR_COR_STATUS
+			eStat = d.Read32(aerCorrReg) &^ corrIgnore
 			if eStat != 0 {
 				report = append(report, fmt.Sprintf("AerCorrSta: %s", bitStatus(uint64(eStat), aerCorrErrDesc)))
 				if clear {
@@ -265,26 +325,75 @@ func errBrowse(w *pci.World, clear bool) {
 //cgo export
 func Main() {
 	delayOpt := flag.Float64("delay", 0.01, "delay between polls of errored link for -mon")
-	nbIter := flag.Int("iters", 5, "number of seconds/iterations for -mon")
+	nbIter := flag.Int("iters", 5, "number of seconds/iterations for -mon/-watch (-1 == forever)")
+	watchOpt := flag.Float64("watch", 0, "rescan pci every <n> seconds and report hotplug/link/slot changes")
 	monLinkOpt := flag.Bool("mon", false, "monitor link for errors")
 	errShowOpt := flag.Bool("err", false, "show err")
 	clearErrOpt := flag.Bool("clearerr", false, "clear error status")
 	optReportUR := flag.Bool("ur", false, "Do not ignore UR")
+	slotsOpt := flag.Bool("slots", false, "show hot-plug slots")
+	devOpt := flag.String("dev", "", "device path (or bus address) to operate on")
+	powerOpt := flag.String("power", "", "with -dev: turn slot power on|off")
+	attnOpt := flag.String("attn", "", "with -dev: set slot attention indicator on|off|blink")
+	aerOpt := flag.Bool("aer", false, "show AER status/mask/severity registers (of -dev or all devices)")
+	aerSetOpt := flag.String("aerset", "", "with -dev: set/clear AER mask/severity bits, eg: uncmask+UR,uncsev-cpl-timeout,corrmask+advisory-nf")
+	injectOpt := flag.String("inject", "", "with -dev: inject corr|nonfatal|fatal (via ACPI EINJ) or ur error and check detection")
+	flag.BoolVar(&kmsgFollow, "kmsg", false, "with -mon: also count kernel AER/DPC reports from /dev/kmsg")
+	policyOpt := flag.String("policy", "", "error policy file (replaces the default policy, see -policydump)")
+	policyDumpOpt := flag.Bool("policydump", false, "print default error policy")
 	flag.BoolVar(&verbose, "v", false, "more info")
 
 	flag.Parse()
 
 	if *optReportUR {
-		aerCorrUrMask = 0
-		aerUncUrMask = 0
+		reportUR = true
 		devExpErrMask = 0
 	}
 
+	if *policyDumpOpt {
+		fmt.Print(defaultPolicy)
+		return
+	}
+	if *policyOpt != "" {
+		loadPolicy(*policyOpt)
+	}
+
 	world := pci.PciInit()
 
 	if *monLinkOpt {
 		monLinks(world, *nbIter, time.Duration(*delayOpt*1e9))
 	}
+	if *slotsOpt {
+		showSlots(world)
+	}
+	if *powerOpt != "" || *attnOpt != "" {
+		if *devOpt == "" {
+			log.Fatalf("-power/-attn need a -dev\n")
+		}
+		slotCmd(world, *devOpt, *powerOpt, *attnOpt)
+	}
+	if *aerSetOpt != "" || *injectOpt != "" {
+		if *devOpt == "" {
+			log.Fatalf("-aerset/-inject need a -dev\n")
+		}
+	}
+	if *aerSetOpt != "" {
+		aerSet(findDev(world, *devOpt), *aerSetOpt)
+	} else if *aerOpt && *devOpt != "" {
+		aerShow(findDev(world, *devOpt))
+	} else if *aerOpt {
+		for _, d := range world.Devs {
+			if d.Ecap[pci.PCI_ECAP_ID_AER] > 0 {
+				aerShow(d)
+			}
+		}
+	}
+	if *injectOpt != "" {
+		inject(world, *devOpt, *injectOpt)
+	}
+	if *watchOpt > 0 {
+		watch(world, *nbIter, time.Duration(*watchOpt*1e9))
+	}
 	if *errShowOpt {
 		errBrowse(world, true)
 	}
@@ -292,8 +401,9 @@ func Main() {
 	if *clearErrOpt {
 		errBrowse(world, true)
 	}
-	if !*monLinkOpt && !*errShowOpt && !*clearErrOpt {
-		showLinks(world, false)
+	devAction := *powerOpt != "" || *attnOpt != "" || *aerSetOpt != "" || *injectOpt != ""
+	if !*monLinkOpt && !*errShowOpt && !*clearErrOpt && *watchOpt <= 0 && !*slotsOpt && !devAction && !*aerOpt {
+		showLinks(world)
 	}
 }
 
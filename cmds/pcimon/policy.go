@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/lprylli/hwmisc/pci"
+)
+
+// Policy rules, one per line: "<match> <action> [<action>...]"
+// match is vvvv:dddd (dddd can be *), *, path=<pcimon path> or name=<pci address>.
+// actions: ignore-unc=<err>,.. ignore-corr=<err>,.. blacklist force threshold=<err/s>
+// Every matching rule applies, in order.
+var defaultPolicy = `
+# UR are usually generated by probing, and set advisory-nf + log-overflow
+*          ignore-unc=UR ignore-corr=advisory-nf,log-overflow
+# AMD GPP root port not advertising AER
+1022:1483  force
+# AMD internal pcie links
+1022:1484  blacklist
+`
+
+type devPolicy struct {
+	uncIgnore, corrIgnore uint32
+	blacklist             bool    // never monitor
+	force                 bool    // monitor link even without AER
+	threshold             float64 // errors/sec before alerting, 0 == none
+}
+
+type policyRule struct {
+	vendor, device int // -1 == any
+	path, name     string
+	devPolicy
+}
+
+var policy = parsePolicy(defaultPolicy, "default-policy")
+
+func (r *policyRule) match(d *pci.PciDev) bool {
+	switch {
+	case r.path != "":
+		return r.path == d.Path
+	case r.name != "":
+		return r.name == d.Name
+	}
+	return (r.vendor == -1 || r.vendor == int(d.Vendor)) && (r.device == -1 || r.device == int(d.Device))
+}
+
+func parseMatch(r *policyRule, m string) error {
+	r.vendor, r.device = -1, -1
+	switch {
+	case m == "*":
+	case strings.HasPrefix(m, "path="):
+		r.path = m[5:]
+	case strings.HasPrefix(m, "name="):
+		r.name = m[5:]
+	default:
+		ids := strings.Split(m, ":")
+		if len(ids) != 2 {
+			return fmt.Errorf("bad match \"%s\"", m)
+		}
+		for i, s := range ids {
+			if s == "*" {
+				continue
+			}
+			v, err := strconv.ParseUint(s, 16, 16)
+			if err != nil {
+				return fmt.Errorf("bad id in \"%s\"", m)
+			}
+			if i == 0 {
+				r.vendor = int(v)
+			} else {
+				r.device = int(v)
+			}
+		}
+	}
+	return nil
+}
+
+func errNames(list string, desc map[int]string) (mask uint32) {
+	for _, e := range strings.Split(list, ",") {
+		mask |= bitByName(e, desc)
+	}
+	return mask
+}
+
+func parsePolicy(def string, file string) (rules []*policyRule) {
+	for n, l := range strings.Split(def, "\n") {
+		if i := strings.Index(l, "#"); i >= 0 {
+			l = l[:i]
+		}
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			log.Fatalf("%s:%d: no action\n", file, n+1)
+		}
+		r := &policyRule{}
+		if err := parseMatch(r, fields[0]); err != nil {
+			log.Fatalf("%s:%d: %s\n", file, n+1, err)
+		}
+		for _, a := range fields[1:] {
+			kv := strings.SplitN(a, "=", 2)
+			switch {
+			case a == "blacklist":
+				r.blacklist = true
+			case a == "force":
+				r.force = true
+			case kv[0] == "ignore-unc" && len(kv) == 2:
+				r.uncIgnore = errNames(kv[1], aerUncErrDesc)
+			case kv[0] == "ignore-corr" && len(kv) == 2:
+				r.corrIgnore = errNames(kv[1], aerCorrErrDesc)
+			case kv[0] == "threshold" && len(kv) == 2:
+				t, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil {
+					log.Fatalf("%s:%d: bad threshold \"%s\"\n", file, n+1, kv[1])
+				}
+				r.threshold = t
+			default:
+				log.Fatalf("%s:%d: unknown action \"%s\"\n", file, n+1, a)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func loadPolicy(file string) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policy = parsePolicy(string(b), file)
+}
+
+func policyFor(d *pci.PciDev) (p devPolicy) {
+	for _, r := range policy {
+		if !r.match(d) {
+			continue
+		}
+		p.uncIgnore |= r.uncIgnore
+		p.corrIgnore |= r.corrIgnore
+		p.blacklist = p.blacklist || r.blacklist
+		p.force = p.force || r.force
+		if r.threshold != 0 {
+			p.threshold = r.threshold
+		}
+	}
+	if reportUR {
+		p.uncIgnore &^= aerUncUr
+		p.corrIgnore &^= aerCorrUr
+	}
+	return p
+}
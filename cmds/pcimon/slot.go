@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/lprylli/hwmisc/pci"
+)
+
+var indicatorVals = map[string]uint16{
+	"on": pci.PCI_EXP_SLTCTL_IND_ON, "blink": pci.PCI_EXP_SLTCTL_IND_BLK, "off": pci.PCI_EXP_SLTCTL_IND_OFF,
+}
+
+func findDev(w *pci.World, path string) *pci.PciDev {
+	d := w.FindByPath(path)
+	if d == nil {
+		log.Fatalf("No device with path or name \"%s\"\n", path)
+	}
+	return d
+}
+
+// The slot for a device path: either the hot-plug port itself, or the port above a card
+// (pcimon displays links by the path of the downstream device).
+func findSlot(w *pci.World, path string) *pci.Slot {
+	d := findDev(w, path)
+	if s := d.Slot(); s != nil {
+		return s
+	}
+	if p := d.Parent(); p != nil && p.LnkChild == d {
+		if s := p.Slot(); s != nil {
+			return s
+		}
+	}
+	log.Fatalf("%s (%s): not a slot\n", d.Path, d.Name)
+	return nil
+}
+
+func showSlots(w *pci.World) {
+	for _, d := range w.Devs {
+		s := d.Slot()
+		if s == nil {
+			continue
+		}
+		child := "empty"
+		if d.LnkChild != nil {
+			child = d.LnkChild.Path
+		}
+		fmt.Printf("%s (%s): %s [%s]\n", d.Path, d.Name, s, child)
+	}
+}
+
+func slotCmd(w *pci.World, path string, power string, attn string) {
+	s := findSlot(w, path)
+	switch power {
+	case "":
+	case "on", "off":
+		log.Printf("%s: slot %d power %s\n", s.Dev.Path, s.Number, power)
+		if err := s.SetPower(power == "on"); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("-power: expect on or off, got \"%s\"\n", power)
+	}
+	if attn != "" {
+		ind, ok := indicatorVals[attn]
+		if !ok {
+			log.Fatalf("-attn: expect on, off or blink, got \"%s\"\n", attn)
+		}
+		if err := s.SetAttnIndicator(ind); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Printf("%s (%s): %s\n", s.Dev.Path, s.Dev.Name, s.Dev.Slot())
+}
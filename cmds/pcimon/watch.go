@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/lprylli/hwmisc/pci"
+)
+
+// Slot Status bits that are worth reporting on change.
+var slotStaDesc = map[int]string{
+	0: "attn-button", 1: "power-fault", 2: "mrl-changed", 3: "presence-changed",
+	5: "mrl-open", 6: "presence", 8: "dll-changed",
+}
+
+const slotStaMask = 0x16f // ignore command-completed and EMI state
+
+type devState struct {
+	name, path  string
+	vendor, dev uint16
+	port        bool
+	speed       int
+	width       int
+	slot        bool
+	slotSta     uint16
+}
+
+type pciEvent struct {
+	Time time.Time
+	Path string
+	Name string
+	Kind string
+	Desc string
+}
+
+func (e *pciEvent) String() string {
+	return fmt.Sprintf("%s %-8s %s (%s): %s", e.Time.Format("15:04:05.000"), e.Kind, e.Path, e.Name, e.Desc)
+}
+
+// State of a device, nil if it vanished while being read.
+func devSnapshot(d *pci.PciDev) (s *devState) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(*pci.DevError); !ok {
+				panic(e)
+			}
+			log.Printf("%s\n", e)
+			s = nil
+		}
+	}()
+	defer d.Uncache()
+	s = &devState{name: d.Name, path: d.Path, vendor: d.Vendor, dev: d.Device}
+	t := d.DevType()
+	if t == pci.PCI_CAP_EXP_TYPE_ROOT_PORT || t == pci.PCI_CAP_EXP_TYPE_DOWNSTREAM {
+		s.port = true
+		d.GetSpeed()
+		s.speed, s.width = d.LnkSpeed, d.LnkWidth
+		s.slot = d.SlotImplemented()
+		s.slotSta = d.SlotStatus() & slotStaMask
+	}
+	return s
+}
+
+func snapshot(w *pci.World) map[string]*devState {
+	states := make(map[string]*devState)
+	for _, d := range w.Devs {
+		if s := devSnapshot(d); s != nil {
+			states[d.Name] = s
+		}
+	}
+	return states
+}
+
+func diffWorlds(prev, cur map[string]*devState, now time.Time) (events []pciEvent) {
+	add := func(s *devState, kind, desc string) {
+		events = append(events, pciEvent{Time: now, Path: s.path, Name: s.name, Kind: kind, Desc: desc})
+	}
+	for name, p := range prev {
+		if _, ok := cur[name]; !ok {
+			add(p, "removed", fmt.Sprintf("%04x:%04x", p.vendor, p.dev))
+		}
+	}
+	for name, c := range cur {
+		p, ok := prev[name]
+		if !ok {
+			add(c, "added", fmt.Sprintf("%04x:%04x", c.vendor, c.dev))
+			continue
+		}
+		if !c.port {
+			continue
+		}
+		if c.speed != p.speed || c.width != p.width {
+			add(c, "link", fmt.Sprintf("x%d.gen%d -> x%d.gen%d", p.width, p.speed, c.width, c.speed))
+		}
+		if c.slot && c.slotSta != p.slotSta {
+			add(c, "slot", fmt.Sprintf("%s-> %s", bitStatus(uint64(p.slotSta), slotStaDesc), bitStatus(uint64(c.slotSta), slotStaDesc)))
+		}
+	}
+	// map order is random, keep the output of successive runs comparable
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Path != events[j].Path {
+			return events[i].Path < events[j].Path
+		}
+		return events[i].Kind < events[j].Kind
+	})
+	return events
+}
+
+// Rescan the pci hierarchy every interval, and report any change compared to previous scan.
+// Devices vanishing during a scan are reported as removed.
+func watch(world *pci.World, nbIter int, interval time.Duration) {
+	pci.Hotplug = true
+	prev := snapshot(world)
+	log.Printf("Watching %d devices\n", len(prev))
+	for i := 0; i < nbIter || nbIter == -1; i++ {
+		time.Sleep(interval)
+		w := pci.PciInit()
+		cur := snapshot(w)
+		w.Release()
+		for _, e := range diffWorlds(prev, cur, time.Now()) {
+			fmt.Printf("%s\n", &e)
+		}
+		prev = cur
+	}
+}
@@ -0,0 +1,255 @@
+package i2cmux
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lprylli/hwmisc/smbus"
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/physic"
+)
+
+// PCA954x i2c multiplexers/switches: each channel is an i2c.Bus, selected on demand.
+
+type Type struct {
+	Name     string
+	Channels int
+	sel      func(c int) byte // control register value selecting channel c
+	mask     byte             // control register bits that read back
+}
+
+func bitSel(c int) byte { return 1 << uint(c) }
+func enSel(c int) byte  { return 4 | byte(c) }
+
+// Largest first, for Detect.
+var Types = []*Type{
+	{"pca9548", 8, bitSel, 0xff},
+	{"pca9546", 4, bitSel, 0x0f},
+	{"pca9545", 4, bitSel, 0x0f}, // interrupt bits 7:4 are read-only
+	{"pca9544", 4, enSel, 0x07},
+	{"pca9540", 2, enSel, 0x07},
+}
+
+// Channel selected by control register value v, -1 if none.
+func (t *Type) Channel(v byte) int {
+	for c := 0; c < t.Channels; c++ {
+		if t.sel(c) == v&t.mask {
+			return c
+		}
+	}
+	return -1
+}
+
+func TypeByName(name string) *Type {
+	for _, t := range Types {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+type Mux struct {
+	Parent i2c.Bus
+	Addr   uint16
+	Type   *Type
+	m      sync.Mutex // serializes channels
+	cur    int        // selected channel, -1 == unknown
+	chans  []i2c.Bus  // one per channel: muxes behind a channel are keyed on it
+}
+
+type muxKey struct {
+	parent i2c.Bus
+	addr   uint16
+}
+
+var muxes = make(map[muxKey]*Mux)
+var muxesLock sync.Mutex
+
+// Mux at addr on parent, shared by all users so channel switches are serialized.
+// typ == nil: detect.
+func New(parent i2c.Bus, addr uint16, typ *Type) (*Mux, error) {
+	muxesLock.Lock()
+	defer muxesLock.Unlock()
+	k := muxKey{parent, addr}
+	if m := muxes[k]; m != nil {
+		return m, nil
+	}
+	if typ == nil {
+		if typ = Detect(parent, addr); typ == nil {
+			return nil, fmt.Errorf("%s/0x%02x: no pca954x mux detected", parent, addr)
+		}
+	}
+	m := &Mux{Parent: parent, Addr: addr, Type: typ, cur: -1, chans: make([]i2c.Bus, typ.Channels)}
+	muxes[k] = m
+	return m, nil
+}
+
+// Detect a PCA954x at addr: the control register reads back what is written.
+// A pca9544 and a pca9540 (fixed address 0x70) cannot be told apart: at 0x70, the
+// pca9540 is assumed, the channels 2-3 of a pca9544 there need an explicit type.
+// Leaves all channels deselected.
+func Detect(bus i2c.Bus, addr uint16) *Type {
+	if addr < 0x70 || addr > 0x77 {
+		return nil
+	}
+	ctl := func(v byte) (byte, bool) {
+		r := make([]byte, 1)
+		if bus.Tx(addr, []byte{v}, nil) != nil || bus.Tx(addr, nil, r) != nil {
+			return 0, false
+		}
+		return r[0], true
+	}
+	var found *Type
+	for _, t := range Types {
+		if t.Name == "pca9544" && addr == 0x70 {
+			continue
+		}
+		last := t.sel(t.Channels - 1)
+		if v, ok := ctl(last); ok && v&t.mask == last {
+			found = t
+			break
+		}
+	}
+	ctl(0)
+	return found
+}
+
+func (m *Mux) String() string {
+	return fmt.Sprintf("%s/0x%02x", m.Parent, m.Addr)
+}
+
+func (m *Mux) selectLocked(c int) error {
+	if m.cur == c {
+		return nil
+	}
+	m.cur = -1
+	v := byte(0)
+	if c >= 0 {
+		v = m.Type.sel(c)
+	}
+	if err := m.Parent.Tx(m.Addr, []byte{v}, nil); err != nil {
+		return fmt.Errorf("%s: selecting channel %d: %s", m, c, err)
+	}
+	m.cur = c
+	return nil
+}
+
+// Deselect all channels.
+func (m *Mux) Disconnect() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.selectLocked(-1)
+}
+
+type channel struct {
+	mux *Mux
+	c   int
+}
+
+type blockChannel struct {
+	channel
+}
+
+// Bus of channel c, also a smbus.BlockBus if the parent is one.
+func (m *Mux) Channel(c int) (i2c.Bus, error) {
+	if c < 0 || c >= m.Type.Channels {
+		return nil, fmt.Errorf("%s: %s has no channel %d", m, m.Type.Name, c)
+	}
+	muxesLock.Lock()
+	defer muxesLock.Unlock()
+	if m.chans[c] == nil {
+		ch := channel{m, c}
+		if _, ok := m.Parent.(smbus.BlockBus); ok {
+			m.chans[c] = &blockChannel{ch}
+		} else {
+			m.chans[c] = &ch
+		}
+	}
+	return m.chans[c], nil
+}
+
+func (ch *channel) String() string {
+	return fmt.Sprintf("%s:%d", ch.mux, ch.c)
+}
+
+func (ch *channel) Tx(addr uint16, w, r []byte) error {
+	m := ch.mux
+	m.m.Lock()
+	defer m.m.Unlock()
+	if err := m.selectLocked(ch.c); err != nil {
+		return err
+	}
+	return m.Parent.Tx(addr, w, r)
+}
+
+func (ch *channel) SetSpeed(f physic.Frequency) error {
+	return ch.mux.Parent.SetSpeed(f)
+}
+
+// Timeout of the parent bus (smbus.TimeoutBus), 0 if it has none.
+func (ch *channel) SetTimeout(d time.Duration) time.Duration {
+	if tb, ok := ch.mux.Parent.(smbus.TimeoutBus); ok {
+		return tb.SetTimeout(d)
+	}
+	return 0
+}
+
+func (ch *blockChannel) TxBlock(addr uint16, w []byte, extra int) ([]byte, error) {
+	m := ch.mux
+	m.m.Lock()
+	defer m.m.Unlock()
+	if err := m.selectLocked(ch.c); err != nil {
+		return nil, err
+	}
+	return m.Parent.(smbus.BlockBus).TxBlock(addr, w, extra)
+}
+
+// Root buses, by number, from which paths are resolved.
+type Tree struct {
+	Root  func(bus int) i2c.Bus
+	roots map[int]i2c.Bus
+}
+
+func NewTree(root func(bus int) i2c.Bus) *Tree {
+	return &Tree{Root: root, roots: make(map[int]i2c.Bus)}
+}
+
+// Root bus busno, opened once so that its muxes are shared.
+func (t *Tree) Bus(busno int) i2c.Bus {
+	if t.roots[busno] == nil {
+		t.roots[busno] = t.Root(busno)
+	}
+	return t.roots[busno]
+}
+
+// Open a device by path, see ParsePath.
+func (t *Tree) Open(path string) (i2c.Bus, uint16, error) {
+	p, err := ParsePath(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return t.OpenPath(p)
+}
+
+// Open a device by parsed path, with the mux types of its hops.
+func (t *Tree) OpenPath(p Path) (i2c.Bus, uint16, error) {
+	bus := t.Bus(p.Bus)
+	for _, h := range p.Hops {
+		var typ *Type
+		if h.Type != "" {
+			if typ = TypeByName(h.Type); typ == nil {
+				return nil, 0, fmt.Errorf("i2c path \"%s\": unknown mux type \"%s\"", p, h.Type)
+			}
+		}
+		m, err := New(bus, h.Addr, typ)
+		if err != nil {
+			return nil, 0, err
+		}
+		if bus, err = m.Channel(h.Channel); err != nil {
+			return nil, 0, err
+		}
+	}
+	return bus, p.Addr, nil
+}
@@ -0,0 +1,68 @@
+package i2cmux
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// One mux crossed by a path.
+type Hop struct {
+	Addr    uint16
+	Type    string // "" == detect
+	Channel int
+}
+
+// Device path: "<bus>/<mux>[@<type>]:<channel>/.../<addr>", eg: "2/0x70:3/0x72".
+type Path struct {
+	Bus  int
+	Hops []Hop
+	Addr uint16
+}
+
+func ParsePath(path string) (p Path, err error) {
+	elems := strings.Split(path, "/")
+	if len(elems) < 2 {
+		return p, fmt.Errorf("i2c path \"%s\": expected <bus>/[<mux>:<channel>/...]<addr>", path)
+	}
+	if p.Bus, err = strconv.Atoi(elems[0]); err != nil {
+		return p, fmt.Errorf("i2c path \"%s\": bad bus \"%s\"", path, elems[0])
+	}
+	for _, e := range elems[1 : len(elems)-1] {
+		mc := strings.SplitN(e, ":", 2)
+		if len(mc) != 2 {
+			return p, fmt.Errorf("i2c path \"%s\": expected <mux>:<channel> in \"%s\"", path, e)
+		}
+		var h Hop
+		if at := strings.Index(mc[0], "@"); at >= 0 {
+			mc[0], h.Type = mc[0][:at], mc[0][at+1:]
+		}
+		addr, err1 := strconv.ParseUint(mc[0], 0, 7)
+		c, err2 := strconv.Atoi(mc[1])
+		if err1 != nil || err2 != nil {
+			return p, fmt.Errorf("i2c path \"%s\": bad mux \"%s\"", path, e)
+		}
+		h.Addr, h.Channel = uint16(addr), c
+		p.Hops = append(p.Hops, h)
+	}
+	addr, err := strconv.ParseUint(elems[len(elems)-1], 0, 7)
+	if err != nil {
+		return p, fmt.Errorf("i2c path \"%s\": bad address \"%s\"", path, elems[len(elems)-1])
+	}
+	p.Addr = uint16(addr)
+	return p, nil
+}
+
+// Canonical form, without mux types: as printed by a scan.
+func (p Path) String() string {
+	s := fmt.Sprintf("%d/", p.Bus)
+	for _, h := range p.Hops {
+		s += fmt.Sprintf("0x%02x:%d/", h.Addr, h.Channel)
+	}
+	return s + fmt.Sprintf("0x%02x", p.Addr)
+}
+
+// Path of the mux of hop i.
+func (p Path) Mux(i int) Path {
+	return Path{Bus: p.Bus, Hops: p.Hops[:i:i], Addr: p.Hops[i].Addr}
+}
@@ -18,7 +18,11 @@ const (
 	PCI_CAPABILITY_LIST    = 0x34
 
 	// Pcie Capability
-	PCI_CAP_ID_EXP = 0x10
+	PCI_CAP_ID_EXP     = 0x10
+	PCI_EXP_FLAGS      = 0x2
+	PCI_EXP_FLAGS_SLOT = 0x100
+	PCI_EXP_LNKSTA     = 0x12
+	PCI_EXP_SLTSTA     = 0x1a
 
 	PCI_CAP_EXP_TYPE_ENDPOINT   = 0
 	PCI_CAP_EXP_TYPE_ROOT_PORT  = 4
@@ -27,7 +31,12 @@ const (
 	PCI_CAP_EXP_TYPE_PCI_BRIDGE = 7
 
 	// PCIe AER Cap
-	PCI_ECAP_ID_AER = 1
+	PCI_ECAP_ID_AER      = 1
+	PCI_ERR_UNCOR_STATUS = 0x4
+	PCI_ERR_UNCOR_MASK   = 0x8
+	PCI_ERR_UNCOR_SEVER  = 0xc
+	PCI_ERR_COR_STATUS   = 0x10
+	PCI_ERR_COR_MASK     = 0x14
 )
 
 type World struct {
@@ -107,11 +116,81 @@ func (d *PciDev) capInit() {
 }
 
 func (d *PciDev) GetSpeed() {
-	lnkSta := d.Read16(d.Ocap[PCI_CAP_ID_EXP] + 0x12)
+	lnkSta := d.Read16(d.Ocap[PCI_CAP_ID_EXP] + PCI_EXP_LNKSTA)
 	d.LnkSpeed = int(lnkSta & 0xf)
 	d.LnkWidth = int((lnkSta >> 4) & 0x3f)
 }
 
+func (d *PciDev) Domain() int {
+	return d.domain
+}
+
+// Requester id: bus*256 + devFn
+func (d *PciDev) ReqId() int {
+	return d.reqId
+}
+
+func (d *PciDev) DevType() int {
+	return d.devType
+}
+
+// True for root/downstream ports whose pcie capability has the Slot Implemented bit.
+func (d *PciDev) SlotImplemented() bool {
+	capExp := d.Ocap[PCI_CAP_ID_EXP]
+	if capExp == 0 || (d.devType != PCI_CAP_EXP_TYPE_ROOT_PORT && d.devType != PCI_CAP_EXP_TYPE_DOWNSTREAM) {
+		return false
+	}
+	return d.Read16(capExp+PCI_EXP_FLAGS)&PCI_EXP_FLAGS_SLOT != 0
+}
+
+func (d *PciDev) SlotStatus() uint16 {
+	if !d.SlotImplemented() {
+		return 0
+	}
+	return d.Read16(d.Ocap[PCI_CAP_ID_EXP] + PCI_EXP_SLTSTA)
+}
+
+// Set when devices may vanish (hot-remove): config access errors panic with a *DevError
+// instead of exiting, and Scan drops such devices.
+var Hotplug bool
+
+type DevError struct {
+	Name string
+	Err  string
+}
+
+func (e *DevError) Error() string {
+	return e.Name + ": " + e.Err
+}
+
+func devFatal(name, format string, args ...interface{}) {
+	if Hotplug {
+		panic(&DevError{Name: name, Err: fmt.Sprintf(format, args...)})
+	}
+	log.Fatalf(format, args...)
+}
+
+// AddDev, dropping the device if it vanishes during the scan (Hotplug).
+func (w *World) addDev(d *PciDev) {
+	n := len(w.Devs)
+	defer func() {
+		if !Hotplug {
+			return
+		}
+		if e := recover(); e != nil {
+			if _, ok := e.(*DevError); !ok {
+				panic(e)
+			}
+			log.Printf("%s: skipped (%s)\n", d.Name, e)
+			w.Devs = w.Devs[:n]
+			if w.Bus[d.secondary] == d {
+				delete(w.Bus, d.secondary)
+			}
+		}
+	}()
+	w.AddDev(d)
+}
+
 func (w *World) AddDev(d *PciDev) {
 	defer d.Uncache()
 	if w.DevFn == nil {
@@ -220,6 +299,31 @@ func (w *World) FindById(vid uint16, did uint16) (l []*PciDev) {
 	return
 }
 
+// Release os resources held by a World (needed when rescanning periodically).
+func (w *World) Release() {
+	for _, d := range w.Devs {
+		d.Uncache()
+	}
+	if w.fd != nil {
+		w.fd.Close()
+		w.fd = nil
+	}
+}
+
+// Lookup a device by nickname path or by its bus address name.
+func (w *World) FindByPath(path string) *PciDev {
+	for _, d := range w.Devs {
+		if d.Path == path || d.Name == path {
+			return d
+		}
+	}
+	return nil
+}
+
+func (d *PciDev) Parent() *PciDev {
+	return d.parent
+}
+
 func PciInit() *World {
 	w := Scan()
 	w.nameCount = make(map[string]int)
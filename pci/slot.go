@@ -0,0 +1,167 @@
+package pci
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	PCI_EXP_SLTCAP = 0x14
+	PCI_EXP_SLTCTL = 0x18
+
+	// Slot Capabilities
+	PCI_EXP_SLTCAP_ABP   = 0x01 // attention button present
+	PCI_EXP_SLTCAP_PCP   = 0x02 // power controller present
+	PCI_EXP_SLTCAP_MRLSP = 0x04 // MRL sensor present
+	PCI_EXP_SLTCAP_AIP   = 0x08 // attention indicator present
+	PCI_EXP_SLTCAP_PIP   = 0x10 // power indicator present
+	PCI_EXP_SLTCAP_HPS   = 0x20 // hot-plug surprise
+	PCI_EXP_SLTCAP_HPC   = 0x40 // hot-plug capable
+	PCI_EXP_SLTCAP_NCCS  = 0x40000
+
+	// Slot Control
+	PCI_EXP_SLTCTL_AIC     = 0x00c0 // attention indicator control
+	PCI_EXP_SLTCTL_PIC     = 0x0300 // power indicator control
+	PCI_EXP_SLTCTL_PCC     = 0x0400 // power controller control (1 == off)
+	PCI_EXP_SLTCTL_IND_ON  = 1
+	PCI_EXP_SLTCTL_IND_BLK = 2
+	PCI_EXP_SLTCTL_IND_OFF = 3
+
+	// Slot Status
+	PCI_EXP_SLTSTA_ABP  = 0x0001
+	PCI_EXP_SLTSTA_PFD  = 0x0002
+	PCI_EXP_SLTSTA_MRLC = 0x0004
+	PCI_EXP_SLTSTA_PDC  = 0x0008
+	PCI_EXP_SLTSTA_CC   = 0x0010
+	PCI_EXP_SLTSTA_MRLS = 0x0020 // MRL open
+	PCI_EXP_SLTSTA_PDS  = 0x0040 // presence detect
+	PCI_EXP_SLTSTA_DLLC = 0x0100
+)
+
+var indicatorNames = []string{"rsvd", "on", "blink", "off"}
+
+type Slot struct {
+	Dev        *PciDev
+	Number     int
+	Cap        uint32
+	Ctl        uint16
+	Sta        uint16
+	PowerLimit float64 // in Watts
+}
+
+// Decode slot registers of a hot-plug port, nil if the Slot Implemented bit is not set.
+func (d *PciDev) Slot() *Slot {
+	if !d.SlotImplemented() {
+		return nil
+	}
+	capExp := d.Ocap[PCI_CAP_ID_EXP]
+	s := &Slot{Dev: d}
+	s.Cap = d.Read32(capExp + PCI_EXP_SLTCAP)
+	s.Ctl = d.Read16(capExp + PCI_EXP_SLTCTL)
+	s.Sta = d.Read16(capExp + PCI_EXP_SLTSTA)
+	s.Number = int(s.Cap >> 19)
+	scale := []float64{1, 0.1, 0.01, 0.001}[(s.Cap>>15)&3]
+	s.PowerLimit = float64((s.Cap>>7)&0xff) * scale
+	return s
+}
+
+func (s *Slot) Has(capBit uint32) bool {
+	return s.Cap&capBit != 0
+}
+
+func (s *Slot) Present() bool {
+	return s.Sta&PCI_EXP_SLTSTA_PDS != 0
+}
+
+func (s *Slot) MrlOpen() bool {
+	return s.Has(PCI_EXP_SLTCAP_MRLSP) && s.Sta&PCI_EXP_SLTSTA_MRLS != 0
+}
+
+// Power is only meaningful when a power controller is present.
+func (s *Slot) PowerOn() bool {
+	return s.Ctl&PCI_EXP_SLTCTL_PCC == 0
+}
+
+func (s *Slot) AttnIndicator() string {
+	return indicatorNames[(s.Ctl&PCI_EXP_SLTCTL_AIC)>>6]
+}
+
+func (s *Slot) PowerIndicator() string {
+	return indicatorNames[(s.Ctl&PCI_EXP_SLTCTL_PIC)>>8]
+}
+
+func (s *Slot) String() string {
+	str := fmt.Sprintf("slot %d: present=%t", s.Number, s.Present())
+	if s.Has(PCI_EXP_SLTCAP_MRLSP) {
+		str += fmt.Sprintf(" mrl-open=%t", s.MrlOpen())
+	}
+	if s.Has(PCI_EXP_SLTCAP_PCP) {
+		str += fmt.Sprintf(" power=%t", s.PowerOn())
+	}
+	if s.Has(PCI_EXP_SLTCAP_AIP) {
+		str += " attn=" + s.AttnIndicator()
+	}
+	if s.Has(PCI_EXP_SLTCAP_PIP) {
+		str += " pwr-led=" + s.PowerIndicator()
+	}
+	if s.Has(PCI_EXP_SLTCAP_ABP) {
+		str += " attn-button"
+	}
+	if s.Has(PCI_EXP_SLTCAP_HPC) {
+		str += " hotplug"
+		if s.Has(PCI_EXP_SLTCAP_HPS) {
+			str += "(surprise)"
+		}
+	}
+	if s.PowerLimit != 0 {
+		str += fmt.Sprintf(" limit=%gW", s.PowerLimit)
+	}
+	return str
+}
+
+// Update Slot Control bits in mask, and wait for the command to complete.
+func (s *Slot) control(mask, val uint16) error {
+	d := s.Dev
+	capExp := d.Ocap[PCI_CAP_ID_EXP]
+	d.Write16(capExp+PCI_EXP_SLTSTA, PCI_EXP_SLTSTA_CC)
+	s.Ctl = (d.Read16(capExp+PCI_EXP_SLTCTL) &^ mask) | (val & mask)
+	d.Write16(capExp+PCI_EXP_SLTCTL, s.Ctl)
+	if s.Has(PCI_EXP_SLTCAP_NCCS) {
+		return nil
+	}
+	expire := time.Now().Add(time.Second)
+	for d.Read16(capExp+PCI_EXP_SLTSTA)&PCI_EXP_SLTSTA_CC == 0 {
+		if time.Now().After(expire) {
+			return fmt.Errorf("%s: slot command 0x%04x not completed", d.Name, s.Ctl)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.Write16(capExp+PCI_EXP_SLTSTA, PCI_EXP_SLTSTA_CC)
+	return nil
+}
+
+func (s *Slot) SetPower(on bool) error {
+	if !s.Has(PCI_EXP_SLTCAP_PCP) {
+		return fmt.Errorf("%s: slot %d has no power controller", s.Dev.Name, s.Number)
+	}
+	var val uint16
+	if !on {
+		val = PCI_EXP_SLTCTL_PCC
+	}
+	return s.control(PCI_EXP_SLTCTL_PCC, val)
+}
+
+// ind is one of PCI_EXP_SLTCTL_IND_ON/BLK/OFF
+func (s *Slot) SetAttnIndicator(ind uint16) error {
+	if !s.Has(PCI_EXP_SLTCAP_AIP) {
+		return fmt.Errorf("%s: slot %d has no attention indicator", s.Dev.Name, s.Number)
+	}
+	return s.control(PCI_EXP_SLTCTL_AIC, ind<<6)
+}
+
+func (s *Slot) SetPowerIndicator(ind uint16) error {
+	if !s.Has(PCI_EXP_SLTCAP_PIP) {
+		return fmt.Errorf("%s: slot %d has no power indicator", s.Dev.Name, s.Number)
+	}
+	return s.control(PCI_EXP_SLTCTL_PIC, ind<<8)
+}
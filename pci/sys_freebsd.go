@@ -49,7 +49,7 @@ func fbsd14Scan(w *World) {
 		d.devFn = int(p.pc_sel.pc_dev)*8 + int(p.pc_sel.pc_func)
 		d.Name = fmt.Sprintf("%04x:%02x:%02x.%x", d.domain, d.bus, d.devFn/8, d.devFn%8)
 		d.sel = p.pc_sel
-		w.AddDev(d)
+		w.addDev(d)
 	}
 }
 
@@ -85,7 +85,7 @@ func fbsdCurrentScan(w *World) {
 		d.devFn = int(p.pc_sel.pc_dev)*8 + int(p.pc_sel.pc_func)
 		d.Name = fmt.Sprintf("%04x:%02x:%02x.%x", d.domain, d.bus, d.devFn/8, d.devFn%8)
 		d.sel = p.pc_sel
-		w.AddDev(d)
+		w.addDev(d)
 	}
 }
 
@@ -118,7 +118,7 @@ func (d *PciDev) Read(off int, l int) []byte {
 		uintptr(unsafe.Pointer(&req)),
 	)
 	if errno != 0 {
-		log.Fatalf("%s:PCIOCREAD(%d,%d):%d\n", d.Name, off, l, errno)
+		devFatal(d.Name, "%s:PCIOCREAD(%d,%d):%d\n", d.Name, off, l, errno)
 	}
 	/*
 		if err != nil || n != l {
@@ -147,7 +147,7 @@ func (d *PciDev) Write(off int, data []byte) {
 		uintptr(unsafe.Pointer(&req)),
 	)
 	if errno != 0 {
-		log.Fatalf("%s:PCIOCWRITE(%d,%d):%d\n", d.Name, off, len(data), errno)
+		devFatal(d.Name, "%s:PCIOCWRITE(%d,%d):%d\n", d.Name, off, len(data), errno)
 	}
 	/*
 		if err != nil || n != len {
@@ -27,7 +27,10 @@ func Scan() *World {
 	for _, f := range files {
 		m, err := os.Stat(pciDir + "/" + f.Name() + "/config")
 
-		if err != nil {
+		if err != nil && Hotplug {
+			log.Printf("%s: skipped (%s)\n", f.Name(), err)
+			continue
+		} else if err != nil {
 			log.Fatalln(err)
 		}
 		//fmt.Printf("%s:%t\n", f.Name(), m.Mode().IsRegular())
@@ -46,7 +49,7 @@ func Scan() *World {
 			if s != d.Name {
 				log.Fatalf("Error with %s (%02x:%02x) != %s", d.Name, d.bus, d.devFn, s)
 			}
-			w.AddDev(&d)
+			w.addDev(&d)
 		}
 	}
 	return &w
@@ -57,14 +60,14 @@ func (d *PciDev) Read(off int, len int) []byte {
 	if d.fd == nil {
 		d.fd, err = os.OpenFile(pciDir+"/"+d.Name+"/config", os.O_RDWR, 0666)
 		if err != nil {
-			log.Fatalln(err)
+			devFatal(d.Name, "%s\n", err)
 		}
 	}
 	buf := make([]byte, len)
 	n, err := d.fd.ReadAt(buf, int64(off))
 	if err != nil || n != len {
 		if !(n == 0 && off == 256 && err == io.EOF) {
-			log.Fatalf("Read(%d, %d)->(%d, %s)\n", off, len, n, err)
+			devFatal(d.Name, "Read(%d, %d)->(%d, %s)\n", off, len, n, err)
 		}
 	}
 	return buf
@@ -75,12 +78,12 @@ func (d *PciDev) Write(off int, data []byte) {
 	if d.fd == nil {
 		d.fd, err = os.OpenFile(pciDir+"/"+d.Name+"/config", os.O_RDWR, 0666)
 		if err != nil {
-			log.Fatalln(err)
+			devFatal(d.Name, "%s\n", err)
 		}
 	}
 	n, err := d.fd.WriteAt(data, int64(off))
 	if err != nil || n != len(data) {
-		log.Fatalf("%s:Write(%d, %d)->(%d, %s)\n", d.Name, off, len(data), n, err)
+		devFatal(d.Name, "%s:Write(%d, %d)->(%d, %s)\n", d.Name, off, len(data), n, err)
 	}
 }
 
@@ -70,12 +70,16 @@ func memHandle(m iomapping) []byte {
 	return data
 }
 
-func Map(name string, hwaddr int64, write bool, ioLen int64) Region {
+func pageMapping(hwaddr int64, write bool, ioLen int64) iomapping {
 	if ioLen == 0 {
 		ioLen = 4096
 	}
 	ioLen += (-ioLen) & 4095 // round-up to number of pages
-	m := iomapping{hwaddr, ioLen, write}
+	return iomapping{hwaddr, ioLen, write}
+}
+
+func Map(name string, hwaddr int64, write bool, ioLen int64) Region {
+	m := pageMapping(hwaddr, write, ioLen)
 	data := hwMaps[m]
 	if data != nil {
 		return data
@@ -84,3 +88,15 @@ func Map(name string, hwaddr int64, write bool, ioLen int64) Region {
 	hwMaps[m] = data
 	return data
 }
+
+// Like Map, but not shared with other callers, to be released with Unmap.
+func MapPrivate(name string, hwaddr int64, write bool, ioLen int64) Region {
+	return &MemRegion{name: name, mem: memHandle(pageMapping(hwaddr, write, ioLen))}
+}
+
+// Release a region returned by MapPrivate.
+func Unmap(r Region) {
+	if err := syscall.Munmap(r.(*MemRegion).mem); err != nil {
+		log.Printf("munmap %s: %s\n", r.Name(), err)
+	}
+}
@@ -0,0 +1,230 @@
+package smbus
+
+import (
+	"fmt"
+	"time"
+
+	"periph.io/x/periph/conn/i2c"
+)
+
+// SMBus protocols over a periph i2c.Bus, with optional PEC.
+
+const (
+	// SMBus clock low timeout (tTIMEOUT), SMBus 2.0/3.0
+	TimeoutMin = 25 * time.Millisecond
+	TimeoutMax = 35 * time.Millisecond
+
+	MaxBlock2 = 32  // SMBus 2.0 block size
+	MaxBlock3 = 255 // SMBus 3.0 block size
+)
+
+// Buses that can read a block whose length is given by the first byte read,
+// followed by extra bytes (PEC), in a single transaction.
+type BlockBus interface {
+	TxBlock(addr uint16, w []byte, extra int) ([]byte, error)
+}
+
+// Buses with a configurable transaction timeout. SetTimeout returns the previous one.
+type TimeoutBus interface {
+	SetTimeout(d time.Duration) time.Duration
+}
+
+type Dev struct {
+	Bus      i2c.Bus
+	Addr     uint16
+	PEC      bool
+	MaxBlock int           // 0 == MaxBlock2
+	Timeout  time.Duration // 0 == TimeoutMax
+}
+
+func New(bus i2c.Bus, addr uint16) *Dev {
+	return &Dev{Bus: bus, Addr: addr}
+}
+
+func (d *Dev) String() string {
+	return fmt.Sprintf("%s/0x%02x", d.Bus, d.Addr)
+}
+
+// CRC-8 (x^8+x^2+x+1) used for Packet Error Code.
+func Crc8(crc byte, b []byte) byte {
+	for _, c := range b {
+		crc ^= c
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// PEC of a transaction: covers address bytes, written and read data.
+func (d *Dev) pec(w, r []byte) byte {
+	crc := byte(0)
+	if len(w) > 0 {
+		crc = Crc8(crc, []byte{byte(d.Addr << 1)})
+		crc = Crc8(crc, w)
+	}
+	if len(r) > 0 {
+		crc = Crc8(crc, []byte{byte(d.Addr<<1 | 1)})
+		crc = Crc8(crc, r)
+	}
+	return crc
+}
+
+// Apply the SMBus timeout for one transaction: the bus is shared with other users,
+// the returned func restores its previous timeout.
+func (d *Dev) setup() func() {
+	tb, ok := d.Bus.(TimeoutBus)
+	if !ok {
+		return func() {}
+	}
+	t := d.Timeout
+	if t == 0 {
+		t = TimeoutMax
+	}
+	prev := tb.SetTimeout(t)
+	return func() { tb.SetTimeout(prev) }
+}
+
+// Transaction writing w then reading n bytes, with PEC appended/checked.
+func (d *Dev) tx(w []byte, n int) ([]byte, error) {
+	defer d.setup()()
+	if d.PEC && n == 0 {
+		w = append(w, d.pec(w, nil))
+	}
+	var r []byte
+	if n > 0 {
+		r = make([]byte, n)
+		if d.PEC {
+			r = make([]byte, n+1)
+		}
+	}
+	if err := d.Bus.Tx(d.Addr, w, r); err != nil {
+		return nil, err
+	}
+	if d.PEC && n > 0 {
+		if p := d.pec(w, r[:n]); p != r[n] {
+			return nil, fmt.Errorf("%s: PEC mismatch (got 0x%02x, expected 0x%02x)", d, r[n], p)
+		}
+		r = r[:n]
+	}
+	return r, nil
+}
+
+// Quick command: address only, with the R/W bit as data.
+func (d *Dev) Quick(read bool) error {
+	defer d.setup()()
+	if read {
+		// no way to read zero bytes through i2c.Bus: read one and NACK it
+		return d.Bus.Tx(d.Addr, nil, make([]byte, 1))
+	}
+	return d.Bus.Tx(d.Addr, nil, nil)
+}
+
+func (d *Dev) SendByte(v byte) error {
+	_, err := d.tx([]byte{v}, 0)
+	return err
+}
+
+func (d *Dev) ReceiveByte() (byte, error) {
+	r, err := d.tx(nil, 1)
+	if err != nil {
+		return 0, err
+	}
+	return r[0], nil
+}
+
+func (d *Dev) WriteByteData(cmd, v byte) error {
+	_, err := d.tx([]byte{cmd, v}, 0)
+	return err
+}
+
+func (d *Dev) ReadByteData(cmd byte) (byte, error) {
+	r, err := d.tx([]byte{cmd}, 1)
+	if err != nil {
+		return 0, err
+	}
+	return r[0], nil
+}
+
+func (d *Dev) WriteWordData(cmd byte, v uint16) error {
+	_, err := d.tx([]byte{cmd, byte(v), byte(v >> 8)}, 0)
+	return err
+}
+
+func (d *Dev) ReadWordData(cmd byte) (uint16, error) {
+	r, err := d.tx([]byte{cmd}, 2)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(r[0]) | uint16(r[1])<<8, nil
+}
+
+func (d *Dev) ProcessCall(cmd byte, v uint16) (uint16, error) {
+	r, err := d.tx([]byte{cmd, byte(v), byte(v >> 8)}, 2)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(r[0]) | uint16(r[1])<<8, nil
+}
+
+func (d *Dev) maxBlock() int {
+	if d.MaxBlock == 0 {
+		return MaxBlock2
+	}
+	return d.MaxBlock
+}
+
+func (d *Dev) BlockWrite(cmd byte, data []byte) error {
+	if len(data) > d.maxBlock() {
+		return fmt.Errorf("%s: block write of %d bytes (max %d)", d, len(data), d.maxBlock())
+	}
+	_, err := d.tx(append([]byte{cmd, byte(len(data))}, data...), 0)
+	return err
+}
+
+// Read a block after writing w: [count] [data...] [PEC].
+func (d *Dev) readBlock(w []byte) ([]byte, error) {
+	defer d.setup()()
+	extra := 0
+	if d.PEC {
+		extra = 1
+	}
+	var r []byte
+	if bb, ok := d.Bus.(BlockBus); ok {
+		var err error
+		if r, err = bb.TxBlock(d.Addr, w, extra); err != nil {
+			return nil, err
+		}
+	} else {
+		// generic bus: read the largest block, the device pads with 0xff
+		r = make([]byte, 1+d.maxBlock()+extra)
+		if err := d.Bus.Tx(d.Addr, w, r); err != nil {
+			return nil, err
+		}
+	}
+	n := int(r[0])
+	if n > d.maxBlock() || 1+n+extra > len(r) {
+		return nil, fmt.Errorf("%s: bad block count %d", d, n)
+	}
+	if d.PEC {
+		if p := d.pec(w, r[:1+n]); p != r[1+n] {
+			return nil, fmt.Errorf("%s: PEC mismatch (got 0x%02x, expected 0x%02x)", d, r[1+n], p)
+		}
+	}
+	return r[1 : 1+n], nil
+}
+
+func (d *Dev) BlockRead(cmd byte) ([]byte, error) {
+	return d.readBlock([]byte{cmd})
+}
+
+func (d *Dev) BlockProcessCall(cmd byte, data []byte) ([]byte, error) {
+	if len(data) > d.maxBlock() {
+		return nil, fmt.Errorf("%s: block process call of %d bytes (max %d)", d, len(data), d.maxBlock())
+	}
+	return d.readBlock(append([]byte{cmd, byte(len(data))}, data...))
+}